@@ -0,0 +1,179 @@
+package apiServer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"resourceManager/components/informer"
+	"resourceManager/conf"
+	"resourceManager/utils/store"
+)
+
+var errNamespaceNotManaged = errors.New("[ERROR] Namespace is not managed")
+
+type PodStatus struct {
+	Name       string     `json:"name"`
+	Namespace  string     `json:"namespace"`
+	Phase      string     `json:"phase"`
+	Reason     string     `json:"reason,omitempty"`
+	NodeName   string     `json:"node"`
+	GPUIndexes []string   `json:"gpus"`
+	VRAM       int        `json:"vram"`
+	Image      string     `json:"image"`
+	StartTime  *time.Time `json:"startTime,omitempty"`
+	FinishTime *time.Time `json:"finishTime,omitempty"`
+}
+
+func GetPodStatus(pod *corev1.Pod) PodStatus {
+	status := PodStatus{
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		Phase:     string(pod.Status.Phase),
+		Reason:    pod.Status.Reason,
+		NodeName:  pod.Spec.NodeName,
+	}
+
+	status.GPUIndexes, _ = informer.GetGPUIndexesFromPod(pod)
+	status.VRAM, _ = informer.GetVRAMFromPod(pod)
+	status.Image = informer.GetImageFromPod(pod)
+
+	if pod.Status.StartTime != nil {
+		startTime := pod.Status.StartTime.Time
+		status.StartTime = &startTime
+	}
+
+	// Pod is finished when its last container terminated
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		terminated := containerStatus.State.Terminated
+		if terminated == nil {
+			status.FinishTime = nil
+			break
+		}
+
+		finishTime := terminated.FinishedAt.Time
+		if status.FinishTime == nil || finishTime.After(*status.FinishTime) {
+			status.FinishTime = &finishTime
+		}
+	}
+
+	return status
+}
+
+func ListPodsHandler(clientset *kubernetes.Clientset) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Every managed namespace unless one is asked for
+		namespaces := conf.ManagedNamespaces()
+		if namespace := r.URL.Query().Get("namespace"); namespace != "" {
+			if !conf.IsManagedNamespace(namespace) {
+				http.Error(w, fmt.Sprintf("[ERROR] Namespace %s is not managed", namespace), http.StatusForbidden)
+				return
+			}
+			namespaces = []string{namespace}
+		}
+
+		statuses := []PodStatus{}
+		for _, namespace := range namespaces {
+			pods, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
+				LabelSelector: "app=gpushare",
+			})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("[ERROR] Failed to list pods: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			for i := range pods.Items {
+				statuses = append(statuses, GetPodStatus(&pods.Items[i]))
+			}
+		}
+
+		writeJSON(w, http.StatusOK, statuses)
+	}
+}
+
+func GetPodHandler(clientset *kubernetes.Clientset) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace := getNamespace(r)
+
+		pod, err := getManagedPod(clientset, namespace, r.PathValue("name"))
+		if err != nil {
+			writePodError(w, namespace, r.PathValue("name"), err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, GetPodStatus(pod))
+	}
+}
+
+// DeletePodHandler removes the pod and returns its vram right away, without waiting for informer
+func DeletePodHandler(clientset *kubernetes.Clientset, rs store.ResourceStore, onRelease func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		namespace := getNamespace(r)
+
+		pod, err := getManagedPod(clientset, namespace, name)
+		if err != nil {
+			writePodError(w, namespace, name, err)
+			return
+		}
+
+		err = clientset.CoreV1().Pods(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			http.Error(w, fmt.Sprintf("[ERROR] Error deleting pod %s: %v", name, err), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[INFO] Pod %s in namespace %s deleted through api\n", name, namespace)
+
+		informer.ReleasePod(rs, pod, onRelease)
+
+		writeJSON(w, http.StatusOK, GetPodStatus(pod))
+	}
+}
+
+// getNamespace is the namespace query parameter, the default managed namespace when it's omitted
+func getNamespace(r *http.Request) string {
+	if namespace := r.URL.Query().Get("namespace"); namespace != "" {
+		return namespace
+	}
+	return conf.DefaultNamespace()
+}
+
+func getManagedPod(clientset *kubernetes.Clientset, namespace string, name string) (*corev1.Pod, error) {
+	if !conf.IsManagedNamespace(namespace) {
+		return nil, errNamespaceNotManaged
+	}
+
+	pod, err := clientset.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Pods not created by the manager aren't exposed
+	if pod.Labels["app"] != "gpushare" {
+		return nil, k8sErrors.NewNotFound(corev1.Resource("pods"), name)
+	}
+
+	return pod, nil
+}
+
+func writePodError(w http.ResponseWriter, namespace string, name string, err error) {
+	if errors.Is(err, errNamespaceNotManaged) {
+		http.Error(w, fmt.Sprintf("[ERROR] Namespace %s is not managed", namespace), http.StatusForbidden)
+		return
+	}
+
+	if k8sErrors.IsNotFound(err) {
+		http.Error(w, fmt.Sprintf("[ERROR] Pod %s not found in namespace %s", name, namespace), http.StatusNotFound)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("[ERROR] Failed to get pod %s: %v", name, err), http.StatusInternalServerError)
+}
@@ -0,0 +1,121 @@
+package apiServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"resourceManager/conf"
+	"resourceManager/utils/store"
+)
+
+type GPUStatus struct {
+	conf.GPUResource
+	Pods []conf.Allocation `json:"pods"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[ERROR] Failed to encode response: %v", err)
+	}
+}
+
+// GetGPUStatus joins every gpu with the pods currently placed on it
+func GetGPUStatus(rs store.ResourceStore) ([]GPUStatus, error) {
+	results, err := rs.ListResources()
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := rs.ListAllocations()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]GPUStatus, 0, len(results))
+	for _, result := range results {
+		status := GPUStatus{GPUResource: result, Pods: []conf.Allocation{}}
+
+		for _, allocation := range allocations {
+			if allocation.NodeName == result.NodeName && allocation.GPUIndex == result.GPUIndex {
+				status.Pods = append(status.Pods, allocation)
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func filterGPUStatus(statuses []GPUStatus, nodeName string, gpuIndex string, minFree int) []GPUStatus {
+	filtered := []GPUStatus{}
+	for _, status := range statuses {
+		if nodeName != "" && status.NodeName != nodeName {
+			continue
+		}
+		if gpuIndex != "" && status.GPUIndex != gpuIndex {
+			continue
+		}
+		if status.VRAMRemain < minFree {
+			continue
+		}
+
+		filtered = append(filtered, status)
+	}
+
+	return filtered
+}
+
+// ListResourcesHandler serves GET /resources, /resources/{node} and /resources/{node}/{gpu}.
+// Query parameters node and minFree narrow the result down
+func ListResourcesHandler(rs store.ResourceStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nodeName := r.PathValue("node")
+		if nodeName == "" {
+			nodeName = r.URL.Query().Get("node")
+		}
+		gpuIndex := r.PathValue("gpu")
+
+		// minFree is a quantity like 512Mi or 2Gi, a bare number is GiB
+		minFree := 0
+		if value := r.URL.Query().Get("minFree"); value != "" {
+			vram, err := conf.ParseVRAM(value)
+			if err != nil || vram < 0 {
+				http.Error(w, "[ERROR] minFree must be a non-negative quantity like 512Mi or 2Gi", http.StatusBadRequest)
+				return
+			}
+			minFree = vram.MiB()
+		}
+
+		statuses, err := GetGPUStatus(rs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("[ERROR] Failed to get resources: %v", err), http.StatusInternalServerError)
+			log.Printf("[ERROR] Fail to get resource: %v", err)
+			return
+		}
+
+		// Unknown node or gpu in path is reported, rather than returning an empty list
+		if r.PathValue("node") != "" && len(filterGPUStatus(statuses, nodeName, gpuIndex, 0)) == 0 {
+			http.Error(w, fmt.Sprintf("[ERROR] GPU resource not found: %s", r.URL.Path), http.StatusNotFound)
+			return
+		}
+
+		filtered := filterGPUStatus(statuses, nodeName, gpuIndex, minFree)
+
+		if gpuIndex != "" {
+			if len(filtered) == 0 {
+				http.Error(w, fmt.Sprintf("[ERROR] GPU %s of [%s] has less than %s vram free", gpuIndex, nodeName, conf.VRAM(minFree)), http.StatusNotFound)
+				return
+			}
+
+			writeJSON(w, http.StatusOK, filtered[0])
+			return
+		}
+
+		writeJSON(w, http.StatusOK, filtered)
+	}
+}
@@ -0,0 +1,179 @@
+package apiServer
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"resourceManager/conf"
+	"resourceManager/utils/store"
+)
+
+// DefaultUsageWindow is reported when from isn't given
+var DefaultUsageWindow = 30 * 24 * time.Hour
+
+type UsageEntry struct {
+	Key          string  `json:"key"`
+	VRAMGiBHours float64 `json:"vramGiBHours"`
+	Pods         int     `json:"pods"`
+	Allocations  int     `json:"allocations"`
+}
+
+type UsageReport struct {
+	From         time.Time    `json:"from"`
+	To           time.Time    `json:"to"`
+	GroupBy      string       `json:"groupBy"`
+	VRAMGiBHours float64      `json:"vramGiBHours"`
+	Usage        []UsageEntry `json:"usage"`
+}
+
+var usageKeys = map[string]func(record conf.AllocationRecord) string{
+	"tenant": func(record conf.AllocationRecord) string { return record.Tenant },
+	"node":   func(record conf.AllocationRecord) string { return record.NodeName },
+	"image":  func(record conf.AllocationRecord) string { return record.Image },
+}
+
+// parseUsageTime accepts RFC3339 timestamps, or dates meaning their midnight in UTC
+func parseUsageTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("[ERROR] Invalid time %q, expected RFC3339 or YYYY-MM-DD", value)
+	}
+
+	return t, nil
+}
+
+// vramGiBHours is how much of record's vram was held between from and to. Outstanding allocations count up to now,
+// hours which haven't happened yet aren't charged
+func vramGiBHours(record conf.AllocationRecord, from time.Time, to time.Time, now time.Time) float64 {
+	start := record.StartedAt
+	if start.Before(from) {
+		start = from
+	}
+
+	end := to
+	if now.Before(end) {
+		end = now
+	}
+	if record.EndedAt != nil && record.EndedAt.Before(end) {
+		end = *record.EndedAt
+	}
+
+	if !end.After(start) {
+		return 0
+	}
+
+	return float64(record.VRAM) / 1024 * end.Sub(start).Hours()
+}
+
+func round(value float64) float64 {
+	return math.Round(value*1000) / 1000
+}
+
+// GetUsage charges every allocation's vram held between from and to to the group it belongs to
+func GetUsage(rs store.ResourceStore, from time.Time, to time.Time, groupBy string) (UsageReport, error) {
+	keyOf, ok := usageKeys[groupBy]
+	if !ok {
+		return UsageReport{}, fmt.Errorf("[ERROR] Invalid groupBy %q, expected tenant, node or image", groupBy)
+	}
+
+	records, err := rs.ListHistory(from, to)
+	if err != nil {
+		return UsageReport{}, err
+	}
+
+	now := time.Now()
+	entries := make(map[string]*UsageEntry)
+	pods := make(map[string]map[string]bool)
+
+	for _, record := range records {
+		key := keyOf(record)
+
+		entry, exists := entries[key]
+		if !exists {
+			entry = &UsageEntry{Key: key}
+			entries[key] = entry
+			pods[key] = make(map[string]bool)
+		}
+
+		entry.VRAMGiBHours += vramGiBHours(record, from, to, now)
+		entry.Allocations++
+		pods[key][record.Namespace+"/"+record.PodName] = true
+	}
+
+	report := UsageReport{From: from, To: to, GroupBy: groupBy, Usage: []UsageEntry{}}
+	for key, entry := range entries {
+		entry.Pods = len(pods[key])
+		report.VRAMGiBHours += entry.VRAMGiBHours
+		entry.VRAMGiBHours = round(entry.VRAMGiBHours)
+		report.Usage = append(report.Usage, *entry)
+	}
+	report.VRAMGiBHours = round(report.VRAMGiBHours)
+
+	// Heaviest users first
+	sort.Slice(report.Usage, func(i, j int) bool {
+		if report.Usage[i].VRAMGiBHours != report.Usage[j].VRAMGiBHours {
+			return report.Usage[i].VRAMGiBHours > report.Usage[j].VRAMGiBHours
+		}
+		return report.Usage[i].Key < report.Usage[j].Key
+	})
+
+	return report, nil
+}
+
+// UsageHandler serves GET /usage?from=&to=&groupBy=tenant|node|image, reporting vram GiB-hours.
+// It covers the last 30 days grouped by tenant unless asked otherwise
+func UsageHandler(rs store.ResourceStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		to := time.Now().UTC()
+		if value := query.Get("to"); value != "" {
+			t, err := parseUsageTime(value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			to = t
+		}
+
+		from := to.Add(-DefaultUsageWindow)
+		if value := query.Get("from"); value != "" {
+			t, err := parseUsageTime(value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			from = t
+		}
+
+		if !from.Before(to) {
+			http.Error(w, "[ERROR] from must be before to", http.StatusBadRequest)
+			return
+		}
+
+		groupBy := query.Get("groupBy")
+		if groupBy == "" {
+			groupBy = "tenant"
+		}
+
+		if _, ok := usageKeys[groupBy]; !ok {
+			http.Error(w, fmt.Sprintf("[ERROR] Invalid groupBy %q, expected tenant, node or image", groupBy), http.StatusBadRequest)
+			return
+		}
+
+		report, err := GetUsage(rs, from, to, groupBy)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("[ERROR] Failed to get usage: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,70 @@
+package apiServer
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"resourceManager/conf"
+)
+
+func TestVRAMGiBHours(t *testing.T) {
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours float64) time.Time { return day.Add(time.Duration(hours * float64(time.Hour))) }
+	ended := func(hours float64) *time.Time { end := at(hours); return &end }
+
+	tests := []struct {
+		name    string
+		record  conf.AllocationRecord
+		from    time.Time
+		to      time.Time
+		now     time.Time
+		wantGiB float64
+	}{
+		{
+			name:   "within window",
+			record: conf.AllocationRecord{VRAM: 2048, StartedAt: at(1), EndedAt: ended(4)},
+			from:   at(0), to: at(24), now: at(48),
+			wantGiB: 6,
+		},
+		{
+			name:   "clipped to window",
+			record: conf.AllocationRecord{VRAM: 1024, StartedAt: at(-10), EndedAt: ended(30)},
+			from:   at(0), to: at(24), now: at(48),
+			wantGiB: 24,
+		},
+		{
+			name:   "outstanding up to now",
+			record: conf.AllocationRecord{VRAM: 4096, StartedAt: at(2)},
+			from:   at(0), to: at(24), now: at(5),
+			wantGiB: 12,
+		},
+		{
+			name:   "future to isn't charged",
+			record: conf.AllocationRecord{VRAM: 1024, StartedAt: at(0)},
+			from:   at(0), to: at(24 * 31), now: at(10),
+			wantGiB: 10,
+		},
+		{
+			name:   "ended before window",
+			record: conf.AllocationRecord{VRAM: 1024, StartedAt: at(-5), EndedAt: ended(-1)},
+			from:   at(0), to: at(24), now: at(48),
+			wantGiB: 0,
+		},
+		{
+			name:   "window in the future",
+			record: conf.AllocationRecord{VRAM: 1024, StartedAt: at(0)},
+			from:   at(30), to: at(40), now: at(10),
+			wantGiB: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := vramGiBHours(tt.record, tt.from, tt.to, tt.now)
+			if math.Abs(got-tt.wantGiB) > 1e-9 {
+				t.Errorf("vramGiBHours = %v, want %v", got, tt.wantGiB)
+			}
+		})
+	}
+}
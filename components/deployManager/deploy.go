@@ -3,25 +3,36 @@ package deployManager
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
+	"resourceManager/components/tenantManager"
 	"resourceManager/conf"
-	"resourceManager/utils/mysql"
+	"resourceManager/utils/store"
 )
 
-func CreatePodSpec(nodeName string, podName string, namespace string, imgName string, gpuIndex string, vram int) *corev1.Pod {
+// VRAMAnnotation keeps pod's exact vram in MiB, aliyun.com/gpu-mem may be rounded up to device plugin's unit
+const VRAMAnnotation = "XRCLOUD_GPU_MEM_MIB"
+
+// CreatePodSpec exposes every gpu in gpuIndexes to the pod, vram is the pod's total in MiB over all of them
+func CreatePodSpec(nodeName string, podName string, namespace string, imgName string, gpuIndexes []string, vram int) *corev1.Pod {
 	now := time.Now()
 
 	annotations := map[string]string{
-		"ALIYUN_COM_GPU_MEM_IDX":         gpuIndex,
+		VRAMAnnotation:                   strconv.Itoa(vram),
+		"ALIYUN_COM_GPU_MEM_IDX":         gpuIndexes[0],
+		"XRCLOUD_GPU_MEM_IDX_LIST":       strings.Join(gpuIndexes, ","),
 		"ALIYUN_COM_GPU_MEM_ASSIGNED":    "false",
 		"ALIYUN_COM_GPU_MEM_ASSUME_TIME": fmt.Sprintf("%d", now.UnixNano()),
 	}
@@ -46,7 +57,7 @@ func CreatePodSpec(nodeName string, podName string, namespace string, imgName st
 			RestartPolicy: corev1.RestartPolicyNever,
 			ImagePullSecrets: []corev1.LocalObjectReference{
 				{
-					Name: "regcred",
+					Name: conf.Get().RegistrySecret,
 				},
 			},
 			Containers: []corev1.Container{
@@ -57,12 +68,12 @@ func CreatePodSpec(nodeName string, podName string, namespace string, imgName st
 					Env: []corev1.EnvVar{
 						{
 							Name:  "NVIDIA_VISIBLE_DEVICES",
-							Value: gpuIndex,
+							Value: strings.Join(gpuIndexes, ","),
 						},
 					},
 					Resources: corev1.ResourceRequirements{
 						Limits: corev1.ResourceList{
-							corev1.ResourceName("aliyun.com/gpu-mem"): resource.MustParse(fmt.Sprintf("%d", vram)),
+							corev1.ResourceName("aliyun.com/gpu-mem"): *resource.NewQuantity(int64(conf.ToDevicePluginUnit(vram)), resource.DecimalSI),
 						},
 					},
 					VolumeMounts: []corev1.VolumeMount{
@@ -90,7 +101,160 @@ func CreatePodSpec(nodeName string, podName string, namespace string, imgName st
 	return podSpec
 }
 
-func DeployPodHandler(clientset *kubernetes.Clientset) http.HandlerFunc {
+var (
+	ErrNoAvailableResource = errors.New("[ERROR] There are no available resources")
+	ErrNamespaceNotAllowed = errors.New("[ERROR] Namespace is not managed")
+	ErrPreemptNotAllowed   = errors.New("[ERROR] Priority class doesn't allow preemption")
+)
+
+func ValidateRequest(req conf.PodCreationRequest) error {
+	if req.PodName == "" || req.Image == "" {
+		return errors.New("[ERROR] Pod name and image are required")
+	}
+
+	if req.VRAMReq <= 0 && req.VRAMPerGPU <= 0 {
+		return errors.New("[ERROR] Requested vram must be greater than 0")
+	}
+
+	if req.GPUs < 0 || req.VRAMPerGPU < 0 {
+		return errors.New("[ERROR] Requested gpus and vram per gpu must not be negative")
+	}
+
+	if req.MaxWait < 0 {
+		return errors.New("[ERROR] Max wait time must not be negative")
+	}
+
+	// Compared in seconds, converting a huge max wait to time.Duration would overflow
+	if req.MaxWait > int(MaxWaitLimit/time.Second) {
+		return fmt.Errorf("[ERROR] Max wait time must not exceed %v", MaxWaitLimit)
+	}
+
+	if _, err := GetPolicy(req.Policy); err != nil {
+		return err
+	}
+
+	// Priority comes from a configured class, a caller can't make itself outrank everyone else
+	class, ok := conf.Get().LookupPriorityClass(req.PriorityClass)
+	if !ok {
+		return fmt.Errorf("[ERROR] Unknown priority class: %s", class.Name)
+	}
+	if req.Preempt && !class.Preempt {
+		return fmt.Errorf("%w: %s", ErrPreemptNotAllowed, class.Name)
+	}
+
+	if !conf.IsManagedNamespace(req.NamespaceOf()) {
+		return fmt.Errorf("%w: %s", ErrNamespaceNotAllowed, req.NamespaceOf())
+	}
+
+	if req.Tenant != "" {
+		if errs := validation.IsValidLabelValue(req.Tenant); len(errs) > 0 {
+			return fmt.Errorf("[ERROR] Invalid tenant %s: %s", req.Tenant, strings.Join(errs, ", "))
+		}
+	}
+
+	return nil
+}
+
+// validationStatus tells requests which aren't allowed apart from malformed ones
+func validationStatus(err error) int {
+	if errors.Is(err, ErrNamespaceNotAllowed) || errors.Is(err, ErrPreemptNotAllowed) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// Reservation is vram held in ledger for a pod which isn't created yet
+type Reservation struct {
+	NodeName      string
+	GPUIndexes    []string
+	VRAMPerGPU    int
+	AllocationIDs []int64
+}
+
+// ReservePod reserves vram for the request on the chosen gpus of one node, without creating its pod.
+// It returns ErrNoAvailableResource when no node can hold the request right now
+func ReservePod(rs store.ResourceStore, req conf.PodCreationRequest) (*Reservation, error) {
+	results, err := rs.ListResources()
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to get available resources: %w", err)
+	}
+
+	vramPerGPU := req.VRAMPerDevice()
+
+	sets, err := SelectGPUSets(results, vramPerGPU, req.GPUCount(), req.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reserve vram on the most preferred gpus, falling back to the next node when they're taken meanwhile
+	for _, set := range sets {
+		var gpuIndexes []string
+		for _, gpu := range set {
+			gpuIndexes = append(gpuIndexes, gpu.GPUIndex)
+		}
+
+		allocationIDs, err := rs.Allocate(req.PodName, req.NamespaceOf(), tenantManager.TenantOf(req), req.Image, set[0].NodeName, gpuIndexes, vramPerGPU)
+		if err == nil {
+			return &Reservation{
+				NodeName:      set[0].NodeName,
+				GPUIndexes:    gpuIndexes,
+				VRAMPerGPU:    vramPerGPU,
+				AllocationIDs: allocationIDs,
+			}, nil
+		}
+
+		if !errors.Is(err, store.ErrNoCapacity) {
+			return nil, fmt.Errorf("[ERROR] Failed to allocate resources: %w", err)
+		}
+
+		log.Printf("[INFO] GPU %s of [%s] was taken meanwhile, retrying next one", strings.Join(gpuIndexes, ","), set[0].NodeName)
+	}
+
+	return nil, ErrNoAvailableResource
+}
+
+// CreateReservedPod creates request's pod on the reserved gpus, the reservation is rolled back when it fails
+func CreateReservedPod(clientset *kubernetes.Clientset, rs store.ResourceStore, req conf.PodCreationRequest, reservation *Reservation) error {
+	namespace := req.NamespaceOf()
+	podSpec := CreatePodSpec(reservation.NodeName, req.PodName, namespace, req.Image, reservation.GPUIndexes, reservation.VRAMPerGPU*len(reservation.GPUIndexes))
+	podSpec.Annotations[PriorityAnnotation] = strconv.Itoa(req.PriorityOf())
+	podSpec.Labels[tenantManager.TenantLabel] = tenantManager.TenantOf(req)
+
+	pod, err := clientset.CoreV1().Pods(namespace).Create(context.TODO(), podSpec, metav1.CreateOptions{})
+	if err != nil {
+		if rollbackErr := rs.Rollback(reservation.AllocationIDs); rollbackErr != nil {
+			log.Printf("[ERROR] %v", rollbackErr)
+		}
+
+		return fmt.Errorf("[ERROR] Error creating pod: %w", err)
+	}
+
+	// Pod's events release only its own allocations from here on, reconciler binds them when this fails
+	if err = rs.BindPod(namespace, req.PodName, string(pod.UID)); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+
+	log.Println("[INFO] Created pod using gpu resource - " + req.PodName + " in namespace [" + namespace + "]")
+
+	return nil
+}
+
+// PlacePod reserves vram for the request and creates its pod on the chosen gpus of one node.
+// It returns ErrNoAvailableResource when no node can hold the request right now
+func PlacePod(clientset *kubernetes.Clientset, rs store.ResourceStore, req conf.PodCreationRequest) (*Reservation, error) {
+	reservation, err := ReservePod(rs, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = CreateReservedPod(clientset, rs, req, reservation); err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
+func DeployPodHandler(clientset *kubernetes.Clientset, rs store.ResourceStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "[ERROR] Invalid request method", http.StatusMethodNotAllowed)
@@ -104,47 +268,51 @@ func DeployPodHandler(clientset *kubernetes.Clientset) http.HandlerFunc {
 			return
 		}
 
-		for {
-			results, err := mysql.GetAvailableResource(clientset)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("[ERROR] Failed to get available resources: %v", err), http.StatusInternalServerError)
-				log.Printf("[ERROR] Fail to get resource: %v", err)
-				return
-			}
-
-			for _, result := range results {
-				if result["is_available"].(int) != 0 {
-					podSpec := CreatePodSpec(result["node_name"].(string), req.PodName, "xrcloud", req.Image, result["gpu_index"].(string), req.VRAMReq)
-
-					_, err := clientset.CoreV1().Pods("xrcloud").Create(context.TODO(), podSpec, metav1.CreateOptions{})
-					if err != nil {
-						if k8sErrors.IsAlreadyExists(err) {
-							http.Error(w, fmt.Sprintf("[ERROR] Pod %s already exists in namespace %s", req.PodName, "xrcloud"), http.StatusConflict)
-							return
-						}
+		if err := ValidateRequest(req); err != nil {
+			http.Error(w, err.Error(), validationStatus(err))
+			return
+		}
 
-						http.Error(w, fmt.Sprintf("[ERROR] Error creating pod: %v", err), http.StatusInternalServerError)
-						return
-					}
+		// Tenant stays locked until placement, so its concurrent requests can't both slip under quota
+		unlock := tenantManager.Lock(tenantManager.TenantOf(req))
+		if err := tenantManager.Admit(rs, []conf.PodCreationRequest{req}); err != nil {
+			unlock()
+			http.Error(w, err.Error(), tenantManager.AdmissionStatus(err))
+			return
+		}
 
-					log.Println("[INFO] Created pod using gpu resource - " + req.PodName + " in namespace [xrcloud]")
+		// Request's context is cancelled on shutdown, so waiting for victims doesn't outlast it
+		_, err := PlacePodWithPreemption(r.Context(), clientset, rs, req)
+		unlock()
+		if err != nil {
+			if errors.Is(err, ErrNoAvailableResource) {
+				// Wait in queue until informer reports returned vram
+				job, err := EnqueueJob(req)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				}
 
-					err = mysql.AllocateResource(clientset, result["node_name"].(string), result["gpu_index"].(string), result["total_vram"].(int), result["vram_usage"].(int), result["vram_remain"].(int), result["is_available"].(int), 2)
-					if err != nil {
-						http.Error(w, fmt.Sprintf("[ERROR] Failed to allocate resources: %v", err), http.StatusInternalServerError)
-						log.Printf("[ERROR] %v", err)
-						return
-					}
+				log.Printf("[INFO] There are no available resources, pod %s is queued as job %s", req.PodName, job.ID)
 
-					responseMessage := fmt.Sprintf("[INFO] Pod '%s' created successfully in namespace [%s]\n", req.PodName, "xrcloud")
-					w.WriteHeader(http.StatusOK)
-					w.Write([]byte(responseMessage))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				json.NewEncoder(w).Encode(job)
+				return
+			}
 
-					return
-				} else {
-					log.Println("[INFO] There are no available resources")
-				}
+			if k8sErrors.IsAlreadyExists(err) {
+				http.Error(w, fmt.Sprintf("[ERROR] Pod %s already exists in namespace %s", req.PodName, req.NamespaceOf()), http.StatusConflict)
+				return
 			}
+
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("[ERROR] %v", err)
+			return
 		}
+
+		responseMessage := fmt.Sprintf("[INFO] Pod '%s' created successfully in namespace [%s]\n", req.PodName, req.NamespaceOf())
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(responseMessage))
 	}
 }
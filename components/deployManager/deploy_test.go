@@ -0,0 +1,363 @@
+package deployManager
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"resourceManager/conf"
+	"resourceManager/utils/store"
+)
+
+func newTestStore(t *testing.T, nodes map[string]int, vramPerGPU int) *store.MemoryStore {
+	t.Helper()
+
+	rs := store.NewMemoryStore()
+	for nodeName, gpus := range nodes {
+		var devices []conf.GPUDevice
+		for i := 0; i < gpus; i++ {
+			devices = append(devices, conf.GPUDevice{Index: fmt.Sprint(i), MemoryMiB: vramPerGPU})
+		}
+		if err := rs.InsertResource(nodeName, devices); err != nil {
+			t.Fatalf("InsertResource(%s): %v", nodeName, err)
+		}
+	}
+
+	return rs
+}
+
+// checkInvariants fails unless every gpu's usage matches its outstanding allocations and stays within its vram
+func checkInvariants(t *testing.T, rs store.ResourceStore) {
+	t.Helper()
+
+	results, err := rs.ListResources()
+	if err != nil {
+		t.Fatalf("ListResources: %v", err)
+	}
+
+	allocations, err := rs.ListAllocations()
+	if err != nil {
+		t.Fatalf("ListAllocations: %v", err)
+	}
+
+	allocated := make(map[string]int)
+	for _, allocation := range allocations {
+		allocated[allocation.NodeName+"/"+allocation.GPUIndex] += allocation.VRAM
+	}
+
+	for _, result := range results {
+		key := result.NodeName + "/" + result.GPUIndex
+
+		if result.VRAMUsage+result.VRAMRemain != result.TotalVRAM {
+			t.Errorf("gpu %s: usage %d + remain %d != total %d", key, result.VRAMUsage, result.VRAMRemain, result.TotalVRAM)
+		}
+		if result.VRAMUsage > result.TotalVRAM || result.VRAMRemain < 0 {
+			t.Errorf("gpu %s is over-allocated: usage %d of %d", key, result.VRAMUsage, result.TotalVRAM)
+		}
+		if result.VRAMUsage != allocated[key] {
+			t.Errorf("gpu %s: usage %d, but ledger holds %d", key, result.VRAMUsage, allocated[key])
+		}
+	}
+}
+
+func TestReservePodConcurrent(t *testing.T) {
+	// 2 nodes of 2 gpus, each holding 6 pods of 4 GiB
+	rs := newTestStore(t, map[string]int{"node-a": 2, "node-b": 2}, 24576)
+	capacity := 4 * 6
+
+	const requests = 100
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	placed := 0
+
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := conf.PodCreationRequest{PodName: fmt.Sprintf("pod-%d", i), Image: "busybox", VRAMReq: conf.VRAM(4096)}
+
+			_, err := ReservePod(rs, req)
+			if err != nil && !errors.Is(err, ErrNoAvailableResource) {
+				t.Errorf("ReservePod(%s): %v", req.PodName, err)
+				return
+			}
+
+			if err == nil {
+				mu.Lock()
+				placed++
+				mu.Unlock()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if placed != capacity {
+		t.Errorf("placed %d pods, want %d", placed, capacity)
+	}
+
+	checkInvariants(t, rs)
+}
+
+func TestReservePod(t *testing.T) {
+	rs := newTestStore(t, map[string]int{"node-a": 2}, 24576)
+
+	// node-a's gpu 0 is partly used, best fit packs onto it
+	if _, err := rs.Allocate("busy", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 16384); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	reservation, err := ReservePod(rs, conf.PodCreationRequest{PodName: "small", Image: "busybox", VRAMReq: conf.VRAM(4096)})
+	if err != nil {
+		t.Fatalf("ReservePod(small): %v", err)
+	}
+	if reservation.GPUIndexes[0] != "0" || reservation.VRAMPerGPU != 4096 || len(reservation.AllocationIDs) != 1 {
+		t.Errorf("ReservePod(small) = %+v, want 4096 MiB on gpu 0", reservation)
+	}
+
+	// Multi-gpu requests split vram evenly over gpus of one node
+	reservation, err = ReservePod(rs, conf.PodCreationRequest{PodName: "pair", Image: "busybox", VRAMReq: conf.VRAM(8192), GPUs: 2})
+	if err != nil {
+		t.Fatalf("ReservePod(pair): %v", err)
+	}
+	if len(reservation.GPUIndexes) != 2 || reservation.VRAMPerGPU != 4096 || len(reservation.AllocationIDs) != 2 {
+		t.Errorf("ReservePod(pair) = %+v, want 4096 MiB on 2 gpus", reservation)
+	}
+
+	// gpu 0 has nothing left, gpu 1 has 20480 MiB
+	_, err = ReservePod(rs, conf.PodCreationRequest{PodName: "big", Image: "busybox", VRAMReq: conf.VRAM(24576)})
+	if !errors.Is(err, ErrNoAvailableResource) {
+		t.Errorf("ReservePod(big) error = %v, want ErrNoAvailableResource", err)
+	}
+
+	checkInvariants(t, rs)
+}
+
+func TestReservePodSkipsUnschedulable(t *testing.T) {
+	rs := newTestStore(t, map[string]int{"node-a": 1, "node-b": 1}, 24576)
+
+	if err := rs.SetSchedulable("node-a", false); err != nil {
+		t.Fatalf("SetSchedulable: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		reservation, err := ReservePod(rs, conf.PodCreationRequest{PodName: fmt.Sprintf("pod-%d", i), Image: "busybox", VRAMReq: conf.VRAM(12288)})
+		if err != nil {
+			t.Fatalf("ReservePod: %v", err)
+		}
+		if reservation.NodeName != "node-b" {
+			t.Errorf("pod-%d reserved on %s, want node-b", i, reservation.NodeName)
+		}
+	}
+
+	_, err := ReservePod(rs, conf.PodCreationRequest{PodName: "pod-2", Image: "busybox", VRAMReq: conf.VRAM(12288)})
+	if !errors.Is(err, ErrNoAvailableResource) {
+		t.Errorf("ReservePod on a full cluster error = %v, want ErrNoAvailableResource", err)
+	}
+}
+
+func TestReservationRollback(t *testing.T) {
+	rs := newTestStore(t, map[string]int{"node-a": 2}, 24576)
+
+	reservation, err := ReservePod(rs, conf.PodCreationRequest{PodName: "pod", Image: "busybox", VRAMReq: conf.VRAM(16384), GPUs: 2})
+	if err != nil {
+		t.Fatalf("ReservePod: %v", err)
+	}
+
+	// Pod couldn't be created, rolling back twice returns its vram once
+	for i := 0; i < 2; i++ {
+		if err = rs.Rollback(reservation.AllocationIDs); err != nil {
+			t.Fatalf("Rollback: %v", err)
+		}
+	}
+
+	results, _ := rs.ListResources()
+	for _, result := range results {
+		if result.VRAMUsage != 0 || result.VRAMRemain != 24576 {
+			t.Errorf("gpu %s: usage %d, remain %d after rollback", result.GPUIndex, result.VRAMUsage, result.VRAMRemain)
+		}
+	}
+
+	allocations, _ := rs.ListAllocations()
+	if len(allocations) != 0 {
+		t.Errorf("%d allocations outstanding after rollback", len(allocations))
+	}
+
+	checkInvariants(t, rs)
+}
+
+func TestValidateRequestBoundsWait(t *testing.T) {
+	limit := int(MaxWaitLimit / time.Second)
+
+	tests := []struct {
+		name    string
+		maxWait int
+		wantErr bool
+	}{
+		{name: "default", maxWait: 0},
+		{name: "at limit", maxWait: limit},
+		{name: "over limit", maxWait: limit + 1, wantErr: true},
+		{name: "overflows duration", maxWait: math.MaxInt64 / 1000, wantErr: true},
+		{name: "negative", maxWait: -1, wantErr: true},
+	}
+
+	for _, test := range tests {
+		err := ValidateRequest(conf.PodCreationRequest{PodName: "pod", Image: "busybox", VRAMReq: conf.VRAM(1024), MaxWait: test.maxWait})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: ValidateRequest(maxWait=%d) error = %v, want error %v", test.name, test.maxWait, err, test.wantErr)
+		}
+	}
+
+	group := conf.GroupCreationRequest{
+		Timeout: int(MaxGroupTimeout/time.Second) + 1,
+		Members: []conf.PodCreationRequest{{PodName: "pod", Image: "busybox", VRAMReq: conf.VRAM(1024)}},
+	}
+	if err := ValidateGroupRequest(group); err == nil {
+		t.Errorf("ValidateGroupRequest(timeout=%d) succeeded, want error", group.Timeout)
+	}
+}
+
+func TestReservationMatchesPodLimit(t *testing.T) {
+	rs := newTestStore(t, map[string]int{"node-a": 1}, 24576)
+
+	// gpu-mem is counted in GiB, kubelet admits 12 pods of 1536Mi on a 24 GiB gpu, not 16
+	placed := 0
+	for i := 0; ; i++ {
+		req := conf.PodCreationRequest{PodName: fmt.Sprintf("pod-%d", i), Image: "busybox", VRAMReq: conf.VRAM(1536)}
+		reservation, err := ReservePod(rs, req)
+		if errors.Is(err, ErrNoAvailableResource) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReservePod(%s): %v", req.PodName, err)
+		}
+		placed++
+
+		pod := CreatePodSpec("node-a", req.PodName, "xrcloud", req.Image, reservation.GPUIndexes, reservation.VRAMPerGPU*len(reservation.GPUIndexes))
+		limit := pod.Spec.Containers[0].Resources.Limits["aliyun.com/gpu-mem"]
+		if charged := conf.FromDevicePluginUnit(int(limit.Value())); charged != reservation.VRAMPerGPU {
+			t.Errorf("%s reserves %d MiB, its pod is charged %d MiB", req.PodName, reservation.VRAMPerGPU, charged)
+		}
+	}
+
+	if placed != 12 {
+		t.Errorf("placed %d pods of 1536Mi on a 24 GiB gpu, want 12", placed)
+	}
+
+	checkInvariants(t, rs)
+}
+
+// loadSettings loads config as the manager does at startup, defaults are restored after the test
+func loadSettings(t *testing.T, config string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, _, err := conf.Load([]string{"-config", path}); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if _, _, err := conf.Load(nil); err != nil {
+			t.Errorf("Load defaults: %v", err)
+		}
+	})
+}
+
+func TestValidateRequestPriorityClass(t *testing.T) {
+	loadSettings(t, `
+priorityClasses:
+  - name: batch
+  - name: interactive
+    priority: 100
+    preempt: true
+  - name: urgent
+    priority: 50
+defaultPriorityClass: batch
+`)
+
+	tests := []struct {
+		class      string
+		preempt    bool
+		wantErr    bool
+		wantStatus int
+	}{
+		{class: ""},
+		{class: "interactive", preempt: true},
+		{class: "urgent"},
+		{class: "urgent", preempt: true, wantErr: true, wantStatus: http.StatusForbidden},
+		{class: "", preempt: true, wantErr: true, wantStatus: http.StatusForbidden},
+		{class: "everything", wantErr: true, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req := conf.PodCreationRequest{PodName: "pod", Image: "busybox", VRAMReq: conf.VRAM(1024), PriorityClass: test.class, Preempt: test.preempt}
+		err := ValidateRequest(req)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ValidateRequest(class=%q, preempt=%t) error = %v, want error %t", test.class, test.preempt, err, test.wantErr)
+			continue
+		}
+		if err != nil && validationStatus(err) != test.wantStatus {
+			t.Errorf("ValidateRequest(class=%q, preempt=%t) status = %d, want %d", test.class, test.preempt, validationStatus(err), test.wantStatus)
+		}
+		if err == nil && req.MayPreempt() != test.preempt {
+			t.Errorf("MayPreempt(class=%q, preempt=%t) = %t", test.class, test.preempt, req.MayPreempt())
+		}
+	}
+
+	// Priority is the class's, a request has no say in it
+	if priority := (conf.PodCreationRequest{PriorityClass: "interactive"}).PriorityOf(); priority != 100 {
+		t.Errorf("PriorityOf(interactive) = %d, want 100", priority)
+	}
+	if priority := (conf.PodCreationRequest{}).PriorityOf(); priority != 0 {
+		t.Errorf("PriorityOf(default) = %d, want 0", priority)
+	}
+}
+
+func TestQueueOrdersByPriorityClass(t *testing.T) {
+	loadSettings(t, `
+priorityClasses:
+  - name: batch
+  - name: interactive
+    priority: 100
+defaultPriorityClass: batch
+`)
+
+	var ids []string
+	for _, class := range []string{"batch", "interactive", "batch", "interactive"} {
+		job, err := EnqueueJob(conf.PodCreationRequest{PodName: "pod-" + fmt.Sprint(len(ids)), Image: "busybox", VRAMReq: conf.VRAM(1024), PriorityClass: class})
+		if err != nil {
+			t.Fatalf("EnqueueJob: %v", err)
+		}
+		ids = append(ids, job.ID)
+	}
+	defer func() {
+		for _, id := range ids {
+			CancelJob(id)
+		}
+	}()
+
+	// Interactive jobs go first, each class in order of arrival
+	want := []string{ids[1], ids[3], ids[0], ids[2]}
+
+	queueMutex.Lock()
+	var got []string
+	for _, job := range pending {
+		got = append(got, job.ID)
+	}
+	queueMutex.Unlock()
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("pending = %v, want %v", got, want)
+	}
+}
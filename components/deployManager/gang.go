@@ -0,0 +1,455 @@
+package deployManager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"resourceManager/components/tenantManager"
+	"resourceManager/conf"
+	"resourceManager/utils/store"
+)
+
+var (
+	DefaultGroupTimeout = 5 * time.Minute
+	MaxGroupTimeout     = time.Hour // partial reservations hold vram nobody uses, so they're held briefly
+
+	groups     = make(map[string]*Group)
+	groupMutex sync.Mutex
+)
+
+type GroupMember struct {
+	Request    conf.PodCreationRequest `json:"request"`
+	NodeName   string                  `json:"node,omitempty"`
+	GPUIndexes []string                `json:"gpus,omitempty"`
+	Reserved   bool                    `json:"reserved"`
+
+	reservation *Reservation
+}
+
+// Group is a gang of pods which is started together, or not at all
+type Group struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name"`
+	Status     string        `json:"status"`
+	Message    string        `json:"message,omitempty"`
+	Members    []GroupMember `json:"members"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	Deadline   time.Time     `json:"deadline"`
+	FinishedAt *time.Time    `json:"finishedAt,omitempty"`
+
+	creating bool // its pods are being created without groupMutex, nothing else touches it meanwhile
+}
+
+// finish ends the group, processGroups forgets it JobRetention later
+func (group *Group) finish(status string) {
+	now := time.Now()
+	group.Status = status
+	group.FinishedAt = &now
+}
+
+// Members waiting for vram count against their tenants' quota, as they were admitted with their group
+func init() {
+	tenantManager.SetPendingRequests(pendingMembers)
+}
+
+// pendingMembers returns members of groups still gathering which aren't reserved yet
+func pendingMembers() []conf.PodCreationRequest {
+	groupMutex.Lock()
+	defer groupMutex.Unlock()
+
+	var pending []conf.PodCreationRequest
+	for _, group := range groups {
+		if group.Status != JobPending {
+			continue
+		}
+		for _, member := range group.Members {
+			if !member.Reserved {
+				pending = append(pending, member.Request)
+			}
+		}
+	}
+
+	return pending
+}
+
+// IsReserved tells whether pod's vram is held by a group which is still gathering its members
+func IsReserved(namespace string, podName string) bool {
+	groupMutex.Lock()
+	defer groupMutex.Unlock()
+
+	for _, group := range groups {
+		if group.Status != JobPending {
+			continue
+		}
+		for _, member := range group.Members {
+			if member.Reserved && member.Request.PodName == podName && member.Request.NamespaceOf() == namespace {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func ValidateGroupRequest(req conf.GroupCreationRequest) error {
+	if len(req.Members) == 0 {
+		return errors.New("[ERROR] Group needs at least one member")
+	}
+
+	if req.Timeout < 0 {
+		return errors.New("[ERROR] Group timeout must not be negative")
+	}
+
+	if req.Timeout > int(MaxGroupTimeout/time.Second) {
+		return fmt.Errorf("[ERROR] Group timeout must not exceed %v", MaxGroupTimeout)
+	}
+
+	names := make(map[string]bool)
+	for _, member := range req.Members {
+		if err := ValidateRequest(member); err != nil {
+			return err
+		}
+
+		name := member.NamespaceOf() + "/" + member.PodName
+		if names[name] {
+			return fmt.Errorf("[ERROR] Pod %s appears twice in group", name)
+		}
+		names[name] = true
+	}
+
+	return nil
+}
+
+func SubmitGroup(clientset *kubernetes.Clientset, rs store.ResourceStore, req conf.GroupCreationRequest) Group {
+	timeout := DefaultGroupTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+
+	now := time.Now()
+	group := &Group{
+		ID:        newJobID(),
+		Name:      req.GroupName,
+		Status:    JobPending,
+		CreatedAt: now,
+		Deadline:  now.Add(timeout),
+	}
+
+	for _, member := range req.Members {
+		group.Members = append(group.Members, GroupMember{Request: member})
+	}
+
+	groupMutex.Lock()
+	groups[group.ID] = group
+	ready := processGroup(rs, group)
+	groupMutex.Unlock()
+
+	if ready {
+		createGroupPods(clientset, rs, group)
+	}
+
+	groupMutex.Lock()
+	snapshot := copyGroup(group)
+	groupMutex.Unlock()
+
+	// Wake queue up so the group's deadline is taken into account
+	NotifyRelease()
+
+	return snapshot
+}
+
+// processGroup reserves vram for members which don't have it yet, and tells whether all of them are reserved.
+// Pods are then created by createGroupPods once groupMutex is released, as k8s calls may take long.
+// groupMutex must be held
+func processGroup(rs store.ResourceStore, group *Group) bool {
+	if group.Status != JobPending || group.creating {
+		return false
+	}
+
+	if time.Now().After(group.Deadline) {
+		rollbackGroup(rs, group)
+		group.finish(JobExpired)
+		group.Message = "[INFO] Timed out waiting for every member's resources"
+		log.Printf("[INFO] Group %s expired, partial reservations are rolled back", group.ID)
+		return false
+	}
+
+	// Firstly, reserve vram for the members still waiting
+	for i := range group.Members {
+		member := &group.Members[i]
+		if member.Reserved {
+			continue
+		}
+
+		reservation, err := ReservePod(rs, member.Request)
+		if err != nil {
+			if errors.Is(err, ErrNoAvailableResource) {
+				continue
+			}
+
+			rollbackGroup(rs, group)
+			group.finish(JobFailed)
+			group.Message = err.Error()
+			log.Printf("[ERROR] Group %s failed: %v", group.ID, err)
+			return false
+		}
+
+		member.reservation = reservation
+		member.Reserved = true
+		member.NodeName = reservation.NodeName
+		member.GPUIndexes = reservation.GPUIndexes
+	}
+
+	for _, member := range group.Members {
+		if !member.Reserved {
+			return false
+		}
+	}
+
+	group.creating = true
+	return true
+}
+
+// createGroupPods creates every pod of a group processGroup found reserved. It's called without groupMutex
+func createGroupPods(clientset *kubernetes.Clientset, rs store.ResourceStore, group *Group) {
+	var err error
+	created := 0
+	for ; created < len(group.Members); created++ {
+		member := group.Members[created]
+		if err = CreateReservedPod(clientset, rs, member.Request, member.reservation); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		// CreateReservedPod already rolled the failed member back, undo the ones created before it
+		for _, member := range group.Members[:created] {
+			deleteGroupPod(clientset, rs, member.Request.NamespaceOf(), member.Request.PodName)
+		}
+	}
+
+	groupMutex.Lock()
+	defer groupMutex.Unlock()
+
+	group.creating = false
+
+	if err != nil {
+		for i := 0; i <= created; i++ {
+			group.Members[i].Reserved = false
+			group.Members[i].reservation = nil
+		}
+		rollbackGroup(rs, group)
+
+		group.finish(JobFailed)
+		group.Message = err.Error()
+		log.Printf("[ERROR] Group %s failed: %v", group.ID, err)
+		return
+	}
+
+	group.finish(JobPlaced)
+	log.Printf("[INFO] Group %s placed all of its %d pods", group.ID, len(group.Members))
+}
+
+func rollbackGroup(rs store.ResourceStore, group *Group) {
+	for i := range group.Members {
+		member := &group.Members[i]
+		if !member.Reserved {
+			continue
+		}
+
+		if err := rs.Rollback(member.reservation.AllocationIDs); err != nil {
+			log.Printf("[ERROR] %v", err)
+		}
+
+		member.Reserved = false
+		member.reservation = nil
+	}
+}
+
+func deleteGroupPod(clientset *kubernetes.Clientset, rs store.ResourceStore, namespace string, podName string) {
+	err := clientset.CoreV1().Pods(namespace).Delete(context.TODO(), podName, metav1.DeleteOptions{})
+	if err != nil {
+		log.Printf("[ERROR] Error deleting pod %s: %v", podName, err)
+	}
+
+	if _, err = rs.Release(namespace, podName, "", store.PhaseCancelled); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+}
+
+func copyGroup(group *Group) Group {
+	snapshot := *group
+	snapshot.Members = append([]GroupMember(nil), group.Members...)
+	return snapshot
+}
+
+// processGroups is run by the queue whenever vram is returned or a deadline passes
+func processGroups(clientset *kubernetes.Clientset, rs store.ResourceStore) {
+	groupMutex.Lock()
+	var ready []*Group
+	for id, group := range groups {
+		if group.FinishedAt != nil && time.Since(*group.FinishedAt) > JobRetention {
+			delete(groups, id)
+			continue
+		}
+
+		if processGroup(rs, group) {
+			ready = append(ready, group)
+		}
+	}
+	groupMutex.Unlock()
+
+	for _, group := range ready {
+		createGroupPods(clientset, rs, group)
+	}
+}
+
+func nextGroupDeadline(wait time.Duration) time.Duration {
+	groupMutex.Lock()
+	defer groupMutex.Unlock()
+
+	for _, group := range groups {
+		if group.Status != JobPending {
+			continue
+		}
+		if d := time.Until(group.Deadline); d < wait {
+			wait = d
+		}
+	}
+
+	return wait
+}
+
+func CancelGroup(rs store.ResourceStore, id string) (Group, error) {
+	groupMutex.Lock()
+	defer groupMutex.Unlock()
+
+	group, ok := groups[id]
+	if !ok {
+		return Group{}, fmt.Errorf("[ERROR] Group %s not found", id)
+	}
+
+	if group.Status != JobPending {
+		return copyGroup(group), fmt.Errorf("[ERROR] Group %s is already %s", id, group.Status)
+	}
+
+	if group.creating {
+		return copyGroup(group), fmt.Errorf("[ERROR] Pods of group %s are being created", id)
+	}
+
+	rollbackGroup(rs, group)
+	group.finish(JobCancelled)
+
+	log.Printf("[INFO] Group %s is cancelled", id)
+
+	return copyGroup(group), nil
+}
+
+// DrainGroups gives back vram reserved by groups still gathering members, nobody creates their pods after shutdown
+func DrainGroups(rs store.ResourceStore) {
+	groupMutex.Lock()
+	defer groupMutex.Unlock()
+
+	for _, group := range groups {
+		// Groups whose pods are being created are finished by createGroupPods
+		if group.Status != JobPending || group.creating {
+			continue
+		}
+
+		rollbackGroup(rs, group)
+		group.finish(JobCancelled)
+		group.Message = "[INFO] Manager is shutting down"
+
+		log.Printf("[INFO] Group %s is cancelled by shutdown, its reservations are rolled back", group.ID)
+	}
+}
+
+func DeployGroupHandler(clientset *kubernetes.Clientset, rs store.ResourceStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req conf.GroupCreationRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "[ERROR] Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := ValidateGroupRequest(req); err != nil {
+			http.Error(w, err.Error(), validationStatus(err))
+			return
+		}
+
+		var tenants []string
+		for _, member := range req.Members {
+			tenants = append(tenants, tenantManager.TenantOf(member))
+		}
+
+		// The whole group is admitted at once, its members count against quota from then on, reserved or not
+		unlock := tenantManager.Lock(tenants...)
+		if err := tenantManager.Admit(rs, req.Members); err != nil {
+			unlock()
+			http.Error(w, err.Error(), tenantManager.AdmissionStatus(err))
+			return
+		}
+
+		group := SubmitGroup(clientset, rs, req)
+		unlock()
+
+		status := http.StatusAccepted
+		switch group.Status {
+		case JobPlaced:
+			status = http.StatusOK
+		case JobFailed:
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(group)
+	}
+}
+
+func GetGroupHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groupMutex.Lock()
+		group, ok := groups[r.PathValue("id")]
+		var snapshot Group
+		if ok {
+			snapshot = copyGroup(group)
+		}
+		groupMutex.Unlock()
+
+		if !ok {
+			http.Error(w, fmt.Sprintf("[ERROR] Group %s not found", r.PathValue("id")), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+	}
+}
+
+func CancelGroupHandler(rs store.ResourceStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group, err := CancelGroup(rs, r.PathValue("id"))
+		if err != nil {
+			if group.ID == "" {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(group)
+	}
+}
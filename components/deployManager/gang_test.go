@@ -0,0 +1,107 @@
+package deployManager
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"resourceManager/components/tenantManager"
+	"resourceManager/conf"
+)
+
+func TestPendingGroupCountsAgainstQuota(t *testing.T) {
+	if err := tenantManager.SetQuotas([]conf.TenantQuota{{Name: "team", MaxVRAM: conf.VRAM(8192)}}); err != nil {
+		t.Fatalf("SetQuotas: %v", err)
+	}
+	defer tenantManager.SetQuotas(nil)
+
+	// One gpu holds a single member, so the group keeps waiting for the other
+	rs := newTestStore(t, map[string]int{"node-a": 1}, 4096)
+
+	req := conf.GroupCreationRequest{
+		GroupName: "gang",
+		Members: []conf.PodCreationRequest{
+			{PodName: "worker-0", Image: "busybox", VRAMReq: conf.VRAM(4096), Tenant: "team"},
+			{PodName: "worker-1", Image: "busybox", VRAMReq: conf.VRAM(4096), Tenant: "team"},
+		},
+	}
+
+	if err := tenantManager.Admit(rs, req.Members); err != nil {
+		t.Fatalf("Admit(group): %v", err)
+	}
+
+	group := SubmitGroup(nil, rs, req)
+	defer CancelGroup(rs, group.ID)
+
+	if group.Status != JobPending {
+		t.Fatalf("group is %s, want %s", group.Status, JobPending)
+	}
+
+	// Group holds 4 GiB and waits for 4 GiB more, team has no room left for another pod
+	err := tenantManager.Admit(rs, []conf.PodCreationRequest{{PodName: "solo", Image: "busybox", VRAMReq: conf.VRAM(4096), Tenant: "team"}})
+	if !errors.Is(err, tenantManager.ErrQuotaExceeded) {
+		t.Errorf("Admit(solo) error = %v, want ErrQuotaExceeded", err)
+	}
+
+	usages, err := tenantManager.GetUsage(rs)
+	if err != nil {
+		t.Fatalf("GetUsage: %v", err)
+	}
+	if usage := usages["team"]; usage.VRAM != 8192 || usage.Pods != 2 {
+		t.Errorf("team uses %d MiB in %d pods, want 8192 in 2", usage.VRAM, usage.Pods)
+	}
+
+	// Cancelled groups don't count anymore
+	if _, err = CancelGroup(rs, group.ID); err != nil {
+		t.Fatalf("CancelGroup: %v", err)
+	}
+	if err = tenantManager.Admit(rs, []conf.PodCreationRequest{{PodName: "solo", Image: "busybox", VRAMReq: conf.VRAM(4096), Tenant: "team"}}); err != nil {
+		t.Errorf("Admit(solo) after cancel: %v", err)
+	}
+}
+
+func TestReservedGroupIsCreatedOutsideLock(t *testing.T) {
+	rs := newTestStore(t, map[string]int{"node-a": 1}, 8192)
+
+	group := &Group{
+		ID:       newJobID(),
+		Status:   JobPending,
+		Deadline: time.Now().Add(time.Minute),
+		Members:  []GroupMember{{Request: conf.PodCreationRequest{PodName: "worker-0", Image: "busybox", VRAMReq: conf.VRAM(4096)}}},
+	}
+
+	groupMutex.Lock()
+	groups[group.ID] = group
+	ready := processGroup(rs, group)
+	groupMutex.Unlock()
+	defer func() {
+		groupMutex.Lock()
+		group.creating = false
+		groupMutex.Unlock()
+		CancelGroup(rs, group.ID)
+	}()
+
+	if !ready || !group.Members[0].Reserved {
+		t.Fatalf("processGroup = %t with member reserved %t, want both", ready, group.Members[0].Reserved)
+	}
+
+	// While its pods are created, the group keeps its reservations and can't be cancelled or drained
+	if !IsReserved(conf.DefaultNamespace(), "worker-0") {
+		t.Errorf("member isn't reserved while its pod is created")
+	}
+	if _, err := CancelGroup(rs, group.ID); err == nil {
+		t.Errorf("CancelGroup succeeded while pods are created")
+	}
+
+	DrainGroups(rs)
+	if group.Status != JobPending || !group.Members[0].Reserved {
+		t.Errorf("DrainGroups touched a group whose pods are created, status %s", group.Status)
+	}
+
+	groupMutex.Lock()
+	again := processGroup(rs, group)
+	groupMutex.Unlock()
+	if again {
+		t.Errorf("processGroup handed the group out twice")
+	}
+}
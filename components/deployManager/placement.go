@@ -0,0 +1,134 @@
+package deployManager
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"resourceManager/conf"
+)
+
+const (
+	BestFit  = "best-fit"
+	WorstFit = "worst-fit"
+	FirstFit = "first-fit"
+)
+
+// PlacementPolicy orders GPUs which can hold the request, most preferred first
+type PlacementPolicy func(candidates []conf.GPUResource, vramReq int) []conf.GPUResource
+
+var (
+	policies = map[string]PlacementPolicy{
+		BestFit:  bestFit,
+		WorstFit: worstFit,
+		FirstFit: firstFit,
+	}
+	defaultPolicy = BestFit
+	policyMutex   sync.RWMutex
+)
+
+func RegisterPolicy(name string, policy PlacementPolicy) {
+	policyMutex.Lock()
+	defer policyMutex.Unlock()
+
+	policies[name] = policy
+}
+
+func SetDefaultPolicy(name string) error {
+	policyMutex.Lock()
+	defer policyMutex.Unlock()
+
+	if _, ok := policies[name]; !ok {
+		return fmt.Errorf("[ERROR] Unknown placement policy: %s", name)
+	}
+
+	defaultPolicy = name
+
+	return nil
+}
+
+func GetPolicy(name string) (PlacementPolicy, error) {
+	policyMutex.RLock()
+	defer policyMutex.RUnlock()
+
+	if name == "" {
+		name = defaultPolicy
+	}
+
+	policy, ok := policies[name]
+	if !ok {
+		return nil, fmt.Errorf("[ERROR] Unknown placement policy: %s", name)
+	}
+
+	return policy, nil
+}
+
+// SelectGPUs filters out GPUs without enough remaining vram, then orders the rest by the policy
+func SelectGPUs(results []conf.GPUResource, vramReq int, policyName string) ([]conf.GPUResource, error) {
+	policy, err := GetPolicy(policyName)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []conf.GPUResource
+
+	for _, result := range results {
+		if result.IsAvailable && result.IsSchedulable && result.VRAMRemain >= vramReq {
+			candidates = append(candidates, result)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	return policy(candidates, vramReq), nil
+}
+
+// SelectGPUSets picks count gpus on a single node for every node which can hold them,
+// nodes and their gpus are ordered by the policy's preference of the gpus
+func SelectGPUSets(results []conf.GPUResource, vramPerGPU int, count int, policyName string) ([][]conf.GPUResource, error) {
+	candidates, err := SelectGPUs(results, vramPerGPU, policyName)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodeOrder []string
+	byNode := make(map[string][]conf.GPUResource)
+
+	for _, candidate := range candidates {
+		if _, ok := byNode[candidate.NodeName]; !ok {
+			nodeOrder = append(nodeOrder, candidate.NodeName)
+		}
+		byNode[candidate.NodeName] = append(byNode[candidate.NodeName], candidate)
+	}
+
+	var sets [][]conf.GPUResource
+	for _, nodeName := range nodeOrder {
+		if gpus := byNode[nodeName]; len(gpus) >= count {
+			sets = append(sets, gpus[:count])
+		}
+	}
+
+	return sets, nil
+}
+
+func firstFit(candidates []conf.GPUResource, vramReq int) []conf.GPUResource {
+	return candidates
+}
+
+func bestFit(candidates []conf.GPUResource, vramReq int) []conf.GPUResource {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].VRAMRemain < candidates[j].VRAMRemain
+	})
+
+	return candidates
+}
+
+func worstFit(candidates []conf.GPUResource, vramReq int) []conf.GPUResource {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].VRAMRemain > candidates[j].VRAMRemain
+	})
+
+	return candidates
+}
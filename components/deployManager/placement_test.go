@@ -0,0 +1,108 @@
+package deployManager
+
+import (
+	"fmt"
+	"testing"
+
+	"resourceManager/conf"
+)
+
+func gpuNames(gpus []conf.GPUResource) []string {
+	var names []string
+	for _, gpu := range gpus {
+		names = append(names, gpu.NodeName+"/"+gpu.GPUIndex)
+	}
+	return names
+}
+
+func TestSelectGPUs(t *testing.T) {
+	unschedulable := fullGPU("node-b", "1", 24576, 20480)
+	unschedulable.IsSchedulable = false
+	unavailable := fullGPU("node-b", "2", 24576, 20480)
+	unavailable.IsAvailable = false
+
+	results := []conf.GPUResource{
+		fullGPU("node-a", "0", 24576, 8192),
+		fullGPU("node-a", "1", 24576, 24576),
+		fullGPU("node-b", "0", 24576, 2048),
+		fullGPU("node-b", "3", 24576, 12288),
+		unschedulable,
+		unavailable,
+	}
+
+	tests := []struct {
+		name          string
+		policy        string
+		defaultPolicy string
+		vram          int
+		want          []string
+		wantErr       bool
+	}{
+		{name: "best fit", policy: BestFit, vram: 4096, want: []string{"node-a/0", "node-b/3", "node-a/1"}},
+		{name: "worst fit", policy: WorstFit, vram: 4096, want: []string{"node-a/1", "node-b/3", "node-a/0"}},
+		{name: "first fit", policy: FirstFit, vram: 4096, want: []string{"node-a/0", "node-a/1", "node-b/3"}},
+		{name: "exactly the remaining vram fits", policy: BestFit, vram: 8192, want: []string{"node-a/0", "node-b/3", "node-a/1"}},
+		{name: "gpus without enough vram are left out", policy: FirstFit, vram: 12289, want: []string{"node-a/1"}},
+		{name: "nothing fits", policy: BestFit, vram: 32768},
+		{name: "default policy", defaultPolicy: BestFit, vram: 4096, want: []string{"node-a/0", "node-b/3", "node-a/1"}},
+		{name: "changed default policy", defaultPolicy: WorstFit, vram: 4096, want: []string{"node-a/1", "node-b/3", "node-a/0"}},
+		{name: "request's policy over default", policy: FirstFit, defaultPolicy: WorstFit, vram: 4096, want: []string{"node-a/0", "node-a/1", "node-b/3"}},
+		{name: "unknown policy", policy: "random", vram: 4096, wantErr: true},
+	}
+
+	defer SetDefaultPolicy(BestFit)
+
+	for _, test := range tests {
+		if err := SetDefaultPolicy(BestFit); err != nil {
+			t.Fatalf("SetDefaultPolicy: %v", err)
+		}
+		if test.defaultPolicy != "" {
+			if err := SetDefaultPolicy(test.defaultPolicy); err != nil {
+				t.Fatalf("%s: SetDefaultPolicy: %v", test.name, err)
+			}
+		}
+
+		// Policies sort in place, every case gets its own copy
+		gpus, err := SelectGPUs(append([]conf.GPUResource(nil), results...), test.vram, test.policy)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: SelectGPUs succeeded, want error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: SelectGPUs: %v", test.name, err)
+			continue
+		}
+
+		if got := gpuNames(gpus); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: SelectGPUs = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSelectGPUSets(t *testing.T) {
+	results := []conf.GPUResource{
+		fullGPU("node-a", "0", 24576, 24576),
+		fullGPU("node-b", "0", 24576, 8192),
+		fullGPU("node-b", "1", 24576, 12288),
+		fullGPU("node-c", "0", 24576, 16384),
+		fullGPU("node-c", "1", 24576, 16384),
+		fullGPU("node-c", "2", 24576, 4096),
+	}
+
+	// Nodes with fewer fitting gpus than asked are skipped, the rest come in order of their preferred gpu
+	sets, err := SelectGPUSets(results, 8192, 2, BestFit)
+	if err != nil {
+		t.Fatalf("SelectGPUSets: %v", err)
+	}
+
+	var got []string
+	for _, set := range sets {
+		got = append(got, fmt.Sprint(gpuNames(set)))
+	}
+	want := []string{"[node-b/0 node-b/1]", "[node-c/0 node-c/1]"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("SelectGPUSets = %v, want %v", got, want)
+	}
+}
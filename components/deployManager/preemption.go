@@ -0,0 +1,324 @@
+package deployManager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"resourceManager/components/informer"
+	"resourceManager/components/tenantManager"
+	"resourceManager/conf"
+	"resourceManager/utils/metrics"
+	"resourceManager/utils/store"
+)
+
+const PriorityAnnotation = "XRCLOUD_PRIORITY"
+
+var (
+	// AllowPreemption lets requests asking for it evict lower priority pods
+	AllowPreemption = true
+
+	// VictimTimeout is how long a preempting request waits for its victims to terminate, unless its context is done first
+	VictimTimeout = 2 * time.Minute
+)
+
+type victim struct {
+	pod      *corev1.Pod
+	priority int
+	vram     map[string]int // vram held on each gpu of the node
+}
+
+func GetPriorityFromPod(pod *corev1.Pod) int {
+	priority, err := strconv.Atoi(pod.Annotations[PriorityAnnotation])
+	if err != nil {
+		return 0
+	}
+
+	return priority
+}
+
+// Preemption is where a request goes, and which pods are evicted to make room for it
+type Preemption struct {
+	NodeName   string
+	GPUIndexes []string
+	Victims    []*corev1.Pod
+}
+
+// PlacePodWithPreemption places the request, evicting lower priority pods first when it asks for it and vram is full.
+// Victims' vram is handed over to the request in one step, and its pod is created once they're gone.
+// When ctx is done before then, e.g. on shutdown, the handed over vram is rolled back
+func PlacePodWithPreemption(ctx context.Context, clientset *kubernetes.Clientset, rs store.ResourceStore, req conf.PodCreationRequest) (*Reservation, error) {
+	reservation, err := PlacePod(clientset, rs, req)
+	if err == nil || !errors.Is(err, ErrNoAvailableResource) || !req.MayPreempt() || !AllowPreemption {
+		return reservation, err
+	}
+
+	preemption, err := SelectVictims(clientset, rs, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if preemption == nil {
+		return nil, ErrNoAvailableResource
+	}
+
+	var victims []store.PodRef
+	for _, pod := range preemption.Victims {
+		victims = append(victims, store.PodRef{Namespace: pod.Namespace, Name: pod.Name})
+	}
+
+	// Nothing else can take victims' vram from here on, it's reserved before they're deleted
+	vramPerGPU := req.VRAMPerDevice()
+	allocationIDs, err := rs.Preempt(victims, req.PodName, req.NamespaceOf(), tenantManager.TenantOf(req), req.Image, preemption.NodeName, preemption.GPUIndexes, vramPerGPU)
+	if errors.Is(err, store.ErrNoCapacity) {
+		// Victims changed meanwhile, the request waits for another try
+		return nil, ErrNoAvailableResource
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to preempt resources: %w", err)
+	}
+
+	reservation = &Reservation{
+		NodeName:      preemption.NodeName,
+		GPUIndexes:    preemption.GPUIndexes,
+		VRAMPerGPU:    vramPerGPU,
+		AllocationIDs: allocationIDs,
+	}
+
+	for _, pod := range preemption.Victims {
+		err = clientset.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			// Victim keeps running on vram which is already handed over, reconciler adopts it again
+			rollbackPreemption(rs, reservation)
+			return nil, fmt.Errorf("[ERROR] Error deleting pod %s: %w", pod.Name, err)
+		}
+
+		log.Printf("[INFO] Pod %s (priority %d) is preempted by pod %s (priority %d)", pod.Name, GetPriorityFromPod(pod), req.PodName, req.PriorityOf())
+		metrics.Add(metrics.Series("resource_manager_preemptions_total"), 1)
+	}
+
+	// Victims use the gpus until they finish terminating, the new pod doesn't start next to them
+	if err = waitForDeletion(ctx, clientset, preemption.Victims); err != nil {
+		rollbackPreemption(rs, reservation)
+		return nil, fmt.Errorf("%w: %v", ErrNoAvailableResource, err)
+	}
+
+	if err = CreateReservedPod(clientset, rs, req, reservation); err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
+func rollbackPreemption(rs store.ResourceStore, reservation *Reservation) {
+	if err := rs.Rollback(reservation.AllocationIDs); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+}
+
+// waitForDeletion returns once every pod is gone, or VictimTimeout passed or ctx is done
+func waitForDeletion(ctx context.Context, clientset *kubernetes.Clientset, pods []*corev1.Pod) error {
+	ctx, cancel := context.WithTimeout(ctx, VictimTimeout)
+	defer cancel()
+
+	for _, pod := range pods {
+		err := wait.PollUntilContextCancel(ctx, time.Second, true, func(ctx context.Context) (bool, error) {
+			current, err := clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			if k8sErrors.IsNotFound(err) {
+				return true, nil
+			}
+			if err != nil {
+				return false, nil
+			}
+			// Pod of the same name was created again meanwhile
+			return current.UID != pod.UID, nil
+		})
+		if err != nil {
+			if ctx.Err() == context.Canceled {
+				return fmt.Errorf("[ERROR] Stopped waiting for pod %s to terminate: %w", pod.Name, ctx.Err())
+			}
+			return fmt.Errorf("[ERROR] Pod %s didn't terminate within %s", pod.Name, VictimTimeout)
+		}
+	}
+
+	return nil
+}
+
+// SelectVictims finds the fewest pods with lower priority than the request, on a single node,
+// whose eviction frees enough vram for it on the returned gpus. Nil is returned when no such set exists
+func SelectVictims(clientset *kubernetes.Clientset, rs store.ResourceStore, req conf.PodCreationRequest) (*Preemption, error) {
+	pods, err := informer.ListGpuSharePods(clientset)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := rs.ListResources()
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := rs.ListAllocations()
+	if err != nil {
+		return nil, err
+	}
+
+	return chooseVictims(pods, results, allocations, req), nil
+}
+
+// chooseVictims makes SelectVictims' choice among the listed pods, gpus and outstanding allocations
+func chooseVictims(pods []corev1.Pod, results []conf.GPUResource, allocations []conf.Allocation, req conf.PodCreationRequest) *Preemption {
+	// Firstly, gather lower priority pods holding vram, per node
+	livePods := make(map[string]*corev1.Pod)
+	for i := range pods {
+		pod := &pods[i]
+		if conf.IsManagedNamespace(pod.Namespace) && pod.DeletionTimestamp == nil && !informer.IsTerminated(pod) {
+			livePods[pod.Namespace+"/"+pod.Name] = pod
+		}
+	}
+
+	victimsByNode := make(map[string]map[string]*victim)
+	for _, allocation := range allocations {
+		pod, ok := livePods[allocation.Namespace+"/"+allocation.PodName]
+		if !ok || IsReserved(allocation.Namespace, allocation.PodName) {
+			continue
+		}
+
+		priority := GetPriorityFromPod(pod)
+		if priority >= req.PriorityOf() {
+			continue
+		}
+
+		if victimsByNode[allocation.NodeName] == nil {
+			victimsByNode[allocation.NodeName] = make(map[string]*victim)
+		}
+
+		key := pod.Namespace + "/" + pod.Name
+		v, ok := victimsByNode[allocation.NodeName][key]
+		if !ok {
+			v = &victim{pod: pod, priority: priority, vram: make(map[string]int)}
+			victimsByNode[allocation.NodeName][key] = v
+		}
+		v.vram[allocation.GPUIndex] += allocation.VRAM
+	}
+
+	// Secondly, for each gpu find the fewest victims freeing enough vram, largest holders first
+	vramPerGPU := req.VRAMPerDevice()
+	count := req.GPUCount()
+
+	gpusByNode := make(map[string][]conf.GPUResource)
+	for _, result := range results {
+		if result.IsSchedulable {
+			gpusByNode[result.NodeName] = append(gpusByNode[result.NodeName], result)
+		}
+	}
+
+	// Nodes are tried in order of name, so ties always go the same way
+	nodeNames := make([]string, 0, len(gpusByNode))
+	for nodeName := range gpusByNode {
+		nodeNames = append(nodeNames, nodeName)
+	}
+	sort.Strings(nodeNames)
+
+	var best *Preemption
+
+	for _, nodeName := range nodeNames {
+		gpus := gpusByNode[nodeName]
+		type gpuChoice struct {
+			gpuIndex string
+			victims  []*victim
+		}
+		var choices []gpuChoice
+
+		for _, gpu := range gpus {
+			need := vramPerGPU - gpu.VRAMRemain
+			if need <= 0 {
+				choices = append(choices, gpuChoice{gpuIndex: gpu.GPUIndex})
+				continue
+			}
+
+			var candidates []*victim
+			for _, v := range victimsByNode[nodeName] {
+				if v.vram[gpu.GPUIndex] > 0 {
+					candidates = append(candidates, v)
+				}
+			}
+
+			sort.Slice(candidates, func(i, j int) bool {
+				if candidates[i].vram[gpu.GPUIndex] != candidates[j].vram[gpu.GPUIndex] {
+					return candidates[i].vram[gpu.GPUIndex] > candidates[j].vram[gpu.GPUIndex]
+				}
+				if candidates[i].priority != candidates[j].priority {
+					return candidates[i].priority < candidates[j].priority
+				}
+				return candidates[i].pod.Namespace+"/"+candidates[i].pod.Name < candidates[j].pod.Namespace+"/"+candidates[j].pod.Name
+			})
+
+			var chosen []*victim
+			freed := 0
+			for _, candidate := range candidates {
+				if freed >= need {
+					break
+				}
+				chosen = append(chosen, candidate)
+				freed += candidate.vram[gpu.GPUIndex]
+			}
+
+			if freed >= need {
+				choices = append(choices, gpuChoice{gpuIndex: gpu.GPUIndex, victims: chosen})
+			}
+		}
+
+		if len(choices) < count {
+			continue
+		}
+
+		// Lastly, take node's gpus one by one, each adding the fewest victims to the ones evicted already.
+		// A victim spanning several gpus is evicted once, so gpus it frees together are preferred
+		preemption := &Preemption{NodeName: nodeName}
+		evicted := make(map[*victim]bool)
+		for len(preemption.GPUIndexes) < count {
+			cheapest, cheapestAdded := 0, -1
+			for i, choice := range choices {
+				added := 0
+				for _, v := range choice.victims {
+					if !evicted[v] {
+						added++
+					}
+				}
+				if cheapestAdded < 0 || added < cheapestAdded {
+					cheapest, cheapestAdded = i, added
+				}
+			}
+
+			choice := choices[cheapest]
+			choices = append(choices[:cheapest], choices[cheapest+1:]...)
+
+			preemption.GPUIndexes = append(preemption.GPUIndexes, choice.gpuIndex)
+			for _, v := range choice.victims {
+				if !evicted[v] {
+					evicted[v] = true
+					preemption.Victims = append(preemption.Victims, v.pod)
+				}
+			}
+		}
+
+		if len(preemption.Victims) == 0 {
+			continue
+		}
+
+		if best == nil || len(preemption.Victims) < len(best.Victims) {
+			best = preemption
+		}
+	}
+
+	return best
+}
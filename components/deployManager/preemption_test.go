@@ -0,0 +1,151 @@
+package deployManager
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"resourceManager/conf"
+)
+
+func gpusharePod(namespace string, name string, priority int) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Labels:      map[string]string{"app": "gpushare"},
+			Annotations: map[string]string{PriorityAnnotation: strconv.Itoa(priority)},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func fullGPU(nodeName string, gpuIndex string, total int, remain int) conf.GPUResource {
+	return conf.GPUResource{NodeName: nodeName, GPUIndex: gpuIndex, TotalVRAM: total, VRAMUsage: total - remain, VRAMRemain: remain, IsAvailable: remain > 0, IsSchedulable: true}
+}
+
+func allocationOf(pod corev1.Pod, nodeName string, gpuIndex string, vram int) conf.Allocation {
+	return conf.Allocation{PodName: pod.Name, Namespace: pod.Namespace, NodeName: nodeName, GPUIndex: gpuIndex, VRAM: vram}
+}
+
+func TestChooseVictims(t *testing.T) {
+	loadSettings(t, `
+priorityClasses:
+  - name: batch
+  - name: interactive
+    priority: 100
+    preempt: true
+defaultPriorityClass: batch
+`)
+
+	big := gpusharePod("xrcloud", "big", 0)
+	small1 := gpusharePod("xrcloud", "small-1", 0)
+	small2 := gpusharePod("xrcloud", "small-2", 0)
+	peer := gpusharePod("xrcloud", "peer", 100)
+	wide := gpusharePod("xrcloud", "wide", 0)
+	other := gpusharePod("elsewhere", "other", 0)
+	finished := gpusharePod("xrcloud", "finished", 0)
+	finished.Status.Phase = corev1.PodSucceeded
+	leaving := gpusharePod("xrcloud", "leaving", 0)
+	leaving.DeletionTimestamp = &metav1.Time{}
+
+	tests := []struct {
+		name        string
+		pods        []corev1.Pod
+		results     []conf.GPUResource
+		allocations []conf.Allocation
+		vram        int
+		gpus        int
+		wantNode    string
+		wantGPUs    []string
+		wantVictims []string // nil when nothing can be preempted
+	}{
+		{
+			name:        "largest holder first",
+			pods:        []corev1.Pod{big, small1, small2},
+			results:     []conf.GPUResource{fullGPU("node-a", "0", 24576, 0)},
+			allocations: []conf.Allocation{allocationOf(small1, "node-a", "0", 6144), allocationOf(big, "node-a", "0", 12288), allocationOf(small2, "node-a", "0", 6144)},
+			vram:        12288,
+			wantNode:    "node-a", wantGPUs: []string{"0"}, wantVictims: []string{"big"},
+		},
+		{
+			name:        "fewest victims across nodes",
+			pods:        []corev1.Pod{small1, small2, big},
+			results:     []conf.GPUResource{fullGPU("node-a", "0", 8192, 0), fullGPU("node-b", "0", 8192, 0)},
+			allocations: []conf.Allocation{allocationOf(small1, "node-a", "0", 4096), allocationOf(small2, "node-a", "0", 4096), allocationOf(big, "node-b", "0", 8192)},
+			vram:        8192,
+			wantNode:    "node-b", wantGPUs: []string{"0"}, wantVictims: []string{"big"},
+		},
+		{
+			name:        "victim over several gpus is evicted once",
+			pods:        []corev1.Pod{wide, small1},
+			results:     []conf.GPUResource{fullGPU("node-a", "0", 8192, 0), fullGPU("node-a", "1", 8192, 0), fullGPU("node-a", "2", 8192, 0)},
+			allocations: []conf.Allocation{allocationOf(wide, "node-a", "0", 8192), allocationOf(small1, "node-a", "1", 8192), allocationOf(wide, "node-a", "2", 8192)},
+			vram:        8192, gpus: 2,
+			wantNode: "node-a", wantGPUs: []string{"0", "2"}, wantVictims: []string{"wide"},
+		},
+		{
+			name:        "free gpu is used alongside",
+			pods:        []corev1.Pod{big},
+			results:     []conf.GPUResource{fullGPU("node-a", "0", 8192, 8192), fullGPU("node-a", "1", 8192, 0)},
+			allocations: []conf.Allocation{allocationOf(big, "node-a", "1", 8192)},
+			vram:        8192, gpus: 2,
+			wantNode: "node-a", wantGPUs: []string{"0", "1"}, wantVictims: []string{"big"},
+		},
+		{
+			name:        "equal priority isn't evicted",
+			pods:        []corev1.Pod{peer},
+			results:     []conf.GPUResource{fullGPU("node-a", "0", 8192, 0)},
+			allocations: []conf.Allocation{allocationOf(peer, "node-a", "0", 8192)},
+			vram:        4096,
+		},
+		{
+			name:        "not enough vram even with every victim",
+			pods:        []corev1.Pod{small1, peer},
+			results:     []conf.GPUResource{fullGPU("node-a", "0", 8192, 0)},
+			allocations: []conf.Allocation{allocationOf(small1, "node-a", "0", 4096), allocationOf(peer, "node-a", "0", 4096)},
+			vram:        8192,
+		},
+		{
+			name:        "terminating, finished and unmanaged pods aren't victims",
+			pods:        []corev1.Pod{leaving, finished, other},
+			results:     []conf.GPUResource{fullGPU("node-a", "0", 24576, 0)},
+			allocations: []conf.Allocation{allocationOf(leaving, "node-a", "0", 8192), allocationOf(finished, "node-a", "0", 8192), allocationOf(other, "node-a", "0", 8192)},
+			vram:        4096,
+		},
+		{
+			name:        "unschedulable gpus aren't freed",
+			pods:        []corev1.Pod{big},
+			results:     []conf.GPUResource{{NodeName: "node-a", GPUIndex: "0", TotalVRAM: 8192, VRAMUsage: 8192}},
+			allocations: []conf.Allocation{allocationOf(big, "node-a", "0", 8192)},
+			vram:        4096,
+		},
+	}
+
+	for _, test := range tests {
+		req := conf.PodCreationRequest{PodName: "session", Image: "busybox", VRAMPerGPU: conf.VRAM(test.vram), GPUs: test.gpus, PriorityClass: "interactive", Preempt: true}
+		preemption := chooseVictims(test.pods, test.results, test.allocations, req)
+
+		if test.wantVictims == nil {
+			if preemption != nil {
+				t.Errorf("%s: chose %+v, want nothing", test.name, preemption)
+			}
+			continue
+		}
+		if preemption == nil {
+			t.Errorf("%s: chose nothing, want %v", test.name, test.wantVictims)
+			continue
+		}
+
+		var victims []string
+		for _, pod := range preemption.Victims {
+			victims = append(victims, pod.Name)
+		}
+
+		if preemption.NodeName != test.wantNode || fmt.Sprint(preemption.GPUIndexes) != fmt.Sprint(test.wantGPUs) || fmt.Sprint(victims) != fmt.Sprint(test.wantVictims) {
+			t.Errorf("%s: chose %v on %s %v, want %v on %s %v", test.name, victims, preemption.NodeName, preemption.GPUIndexes, test.wantVictims, test.wantNode, test.wantGPUs)
+		}
+	}
+}
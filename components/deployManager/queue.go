@@ -0,0 +1,299 @@
+package deployManager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"resourceManager/components/tenantManager"
+	"resourceManager/conf"
+	"resourceManager/utils/store"
+)
+
+const (
+	JobPending   = "Pending"
+	JobPlaced    = "Placed"
+	JobFailed    = "Failed"
+	JobExpired   = "Expired"
+	JobCancelled = "Cancelled"
+)
+
+var (
+	MaxQueueLength = 100
+	DefaultMaxWait = 10 * time.Minute
+	MaxWaitLimit   = 24 * time.Hour // longest max wait a request may ask for
+	JobRetention   = time.Hour
+
+	jobs       = make(map[string]*Job)
+	pending    []*Job
+	queueMutex sync.Mutex
+	releaseCh  = make(chan struct{}, 1)
+)
+
+type Job struct {
+	ID         string                  `json:"id"`
+	Request    conf.PodCreationRequest `json:"request"`
+	Status     string                  `json:"status"`
+	Message    string                  `json:"message,omitempty"`
+	NodeName   string                  `json:"node,omitempty"`
+	GPUIndexes []string                `json:"gpus,omitempty"`
+	CreatedAt  time.Time               `json:"createdAt"`
+	Deadline   time.Time               `json:"deadline"`
+	FinishedAt *time.Time              `json:"finishedAt,omitempty"`
+
+	placing bool
+}
+
+// finish moves the job out of pending, it's kept for JobRetention from now on
+func (job *Job) finish(status string) {
+	now := time.Now()
+	job.Status = status
+	job.FinishedAt = &now
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func EnqueueJob(req conf.PodCreationRequest) (Job, error) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	if len(pending) >= MaxQueueLength {
+		return Job{}, fmt.Errorf("[ERROR] Pending queue is full (%d jobs)", MaxQueueLength)
+	}
+
+	maxWait := DefaultMaxWait
+	if req.MaxWait > 0 {
+		maxWait = time.Duration(req.MaxWait) * time.Second
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:        newJobID(),
+		Request:   req,
+		Status:    JobPending,
+		CreatedAt: now,
+		Deadline:  now.Add(maxWait),
+	}
+
+	jobs[job.ID] = job
+
+	// Pending jobs are ordered by priority, then by arrival
+	i := len(pending)
+	for i > 0 && pending[i-1].Request.PriorityOf() < req.PriorityOf() {
+		i--
+	}
+	pending = slices.Insert(pending, i, job)
+
+	// Wake queue up so the new deadline is taken into account
+	NotifyRelease()
+
+	return *job, nil
+}
+
+func GetJob(id string) (Job, bool) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	job, ok := jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	return *job, true
+}
+
+func CancelJob(id string) (Job, error) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	job, ok := jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("[ERROR] Job %s not found", id)
+	}
+
+	if job.Status != JobPending {
+		return *job, fmt.Errorf("[ERROR] Job %s is already %s", id, job.Status)
+	}
+
+	if job.placing {
+		return *job, fmt.Errorf("[ERROR] Job %s is being placed", id)
+	}
+
+	job.finish(JobCancelled)
+	removePending(job)
+
+	log.Printf("[INFO] Job %s is cancelled", id)
+
+	return *job, nil
+}
+
+func removePending(job *Job) {
+	for i, p := range pending {
+		if p == job {
+			pending = append(pending[:i], pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// NotifyRelease wakes the queue up, it's called whenever vram is returned
+func NotifyRelease() {
+	select {
+	case releaseCh <- struct{}{}:
+	default:
+	}
+}
+
+// RunQueue places pending jobs whenever vram is returned, and expires the ones waiting too long
+func RunQueue(clientset *kubernetes.Clientset, rs store.ResourceStore, stopCh <-chan struct{}) {
+	// Placement in progress stops waiting for victims once the queue is stopped
+	ctx := wait.ContextForChannel(stopCh)
+
+	for {
+		timer := time.NewTimer(nextDeadline())
+
+		select {
+		case <-stopCh:
+			timer.Stop()
+			return
+		case <-releaseCh:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		processQueue(ctx, clientset, rs)
+		processGroups(clientset, rs)
+	}
+}
+
+func nextDeadline() time.Duration {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	wait := DefaultMaxWait
+	for _, job := range pending {
+		if d := time.Until(job.Deadline); d < wait {
+			wait = d
+		}
+	}
+
+	wait = nextGroupDeadline(wait)
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait
+}
+
+func processQueue(ctx context.Context, clientset *kubernetes.Clientset, rs store.ResourceStore) {
+	queueMutex.Lock()
+	// Forget finished jobs after a while
+	for id, job := range jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > JobRetention {
+			delete(jobs, id)
+		}
+	}
+
+	snapshot := make([]*Job, len(pending))
+	copy(snapshot, pending)
+	queueMutex.Unlock()
+
+	for _, job := range snapshot {
+		queueMutex.Lock()
+		if job.Status != JobPending {
+			queueMutex.Unlock()
+			continue
+		}
+
+		if time.Now().After(job.Deadline) {
+			job.finish(JobExpired)
+			job.Message = "[INFO] Timed out waiting for available resources"
+			removePending(job)
+			queueMutex.Unlock()
+
+			log.Printf("[INFO] Job %s expired waiting for resources", job.ID)
+			continue
+		}
+		req := job.Request
+		job.placing = true
+		queueMutex.Unlock()
+
+		// Tenant may have used up its quota meanwhile, the job waits for it as for vram
+		unlock := tenantManager.Lock(tenantManager.TenantOf(req))
+		err := tenantManager.Admit(rs, []conf.PodCreationRequest{req})
+		var reservation *Reservation
+		if err == nil {
+			reservation, err = PlacePodWithPreemption(ctx, clientset, rs, req)
+		}
+		unlock()
+
+		queueMutex.Lock()
+		job.placing = false
+
+		if err != nil {
+			if errors.Is(err, ErrNoAvailableResource) || errors.Is(err, tenantManager.ErrQuotaExceeded) {
+				queueMutex.Unlock()
+				continue
+			}
+
+			job.finish(JobFailed)
+			job.Message = err.Error()
+			log.Printf("[ERROR] Job %s failed: %v", job.ID, err)
+		} else {
+			job.finish(JobPlaced)
+			job.NodeName = reservation.NodeName
+			job.GPUIndexes = reservation.GPUIndexes
+			log.Printf("[INFO] Job %s placed pod %s", job.ID, req.PodName)
+		}
+
+		removePending(job)
+		queueMutex.Unlock()
+	}
+}
+
+func GetJobHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := GetJob(r.PathValue("id"))
+		if !ok {
+			http.Error(w, fmt.Sprintf("[ERROR] Job %s not found", r.PathValue("id")), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+func CancelJobHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		job, err := CancelJob(id)
+		if err != nil {
+			if _, ok := GetJob(id); !ok {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	}
+}
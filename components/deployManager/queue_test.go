@@ -0,0 +1,90 @@
+package deployManager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"resourceManager/conf"
+)
+
+func TestJobRetentionStartsWhenFinished(t *testing.T) {
+	// A job cancelled long before its deadline is still forgotten JobRetention after cancellation
+	early, err := EnqueueJob(conf.PodCreationRequest{PodName: "early", Image: "busybox", VRAMReq: conf.VRAM(1024), MaxWait: 24 * 3600})
+	if err != nil {
+		t.Fatalf("EnqueueJob(early): %v", err)
+	}
+	if _, err = CancelJob(early.ID); err != nil {
+		t.Fatalf("CancelJob(early): %v", err)
+	}
+
+	// A job finished just now is kept, however long ago its deadline passed
+	late, err := EnqueueJob(conf.PodCreationRequest{PodName: "late", Image: "busybox", VRAMReq: conf.VRAM(1024)})
+	if err != nil {
+		t.Fatalf("EnqueueJob(late): %v", err)
+	}
+	if _, err = CancelJob(late.ID); err != nil {
+		t.Fatalf("CancelJob(late): %v", err)
+	}
+
+	queueMutex.Lock()
+	finished := time.Now().Add(-JobRetention - time.Minute)
+	jobs[early.ID].FinishedAt = &finished
+	jobs[late.ID].Deadline = time.Now().Add(-JobRetention - time.Minute)
+	queueMutex.Unlock()
+
+	processQueue(context.Background(), nil, nil)
+
+	if _, ok := GetJob(early.ID); ok {
+		t.Errorf("job finished %v ago is still kept", JobRetention+time.Minute)
+	}
+	if _, ok := GetJob(late.ID); !ok {
+		t.Errorf("job finished just now is forgotten")
+	}
+
+	queueMutex.Lock()
+	delete(jobs, late.ID)
+	queueMutex.Unlock()
+}
+
+func TestGroupRetentionStartsWhenFinished(t *testing.T) {
+	rs := newTestStore(t, map[string]int{"node-a": 1}, 4096)
+
+	// The group can't gather both members, so it's pending until cancelled
+	group := SubmitGroup(nil, rs, conf.GroupCreationRequest{
+		GroupName: "gang",
+		Timeout:   24 * 3600,
+		Members: []conf.PodCreationRequest{
+			{PodName: "worker-0", Image: "busybox", VRAMReq: conf.VRAM(4096)},
+			{PodName: "worker-1", Image: "busybox", VRAMReq: conf.VRAM(4096)},
+		},
+	})
+
+	cancelled, err := CancelGroup(rs, group.ID)
+	if err != nil {
+		t.Fatalf("CancelGroup: %v", err)
+	}
+	if cancelled.FinishedAt == nil {
+		t.Fatalf("cancelled group has no finish time")
+	}
+
+	processGroups(nil, rs)
+
+	groupMutex.Lock()
+	if _, ok := groups[group.ID]; !ok {
+		groupMutex.Unlock()
+		t.Fatalf("group finished just now is forgotten")
+	}
+	finished := time.Now().Add(-JobRetention - time.Minute)
+	groups[group.ID].FinishedAt = &finished
+	groupMutex.Unlock()
+
+	processGroups(nil, rs)
+
+	groupMutex.Lock()
+	_, ok := groups[group.ID]
+	groupMutex.Unlock()
+	if ok {
+		t.Errorf("group finished %v ago is still kept", JobRetention+time.Minute)
+	}
+}
@@ -12,16 +12,14 @@ import (
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-	"resourceManager/utils/mysql"
+	"resourceManager/conf"
 	"resourceManager/utils/nvidia"
+	"resourceManager/utils/store"
 )
 
 var (
 	existingNodes = map[string]struct{}{}
 	mu            sync.Mutex
-	namespace     = "xrcloud"
-	ids           []string
-	vram          []int
 )
 
 func IsGpuShareNode(node *corev1.Node) bool {
@@ -54,7 +52,7 @@ func GetNodeIP(node *corev1.Node) string {
 	return ""
 }
 
-func WaitForSecret(clientset *kubernetes.Clientset, nodeName string) string {
+func WaitForSecret(clientset *kubernetes.Clientset, nodeName string) (string, error) {
 	timeout := time.After(5 * time.Minute) // Adjust the timeout as needed
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
@@ -62,16 +60,19 @@ func WaitForSecret(clientset *kubernetes.Clientset, nodeName string) string {
 	for {
 		select {
 		case <-timeout:
-			log.Fatalf("[ERROR] Timed out waiting for secret")
+			return "", fmt.Errorf("[ERROR] Timed out waiting for secret of node %s", nodeName)
 		case <-ticker.C:
-			secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), fmt.Sprintf("%s-root-password", nodeName), metav1.GetOptions{})
+			settings := conf.Get()
+			secretName := fmt.Sprintf(settings.Secrets.NodePassword, nodeName)
+
+			secret, err := clientset.CoreV1().Secrets(settings.Namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
 			if err == nil {
 				password, ok := secret.Data["password"]
 				if !ok {
-					log.Fatalf("[ERROR] Password key not found in secret")
+					return "", fmt.Errorf("[ERROR] Password key not found in secret of node %s", nodeName)
 				}
 
-				return string(password)
+				return string(password), nil
 			}
 
 			log.Printf("[INFO] Secret not found for node %s, retrying...", nodeName)
@@ -79,7 +80,48 @@ func WaitForSecret(clientset *kubernetes.Clientset, nodeName string) string {
 	}
 }
 
-func CreateNodeInformer(clientset *kubernetes.Clientset) cache.SharedInformer {
+// RegisterGpuNode discovers node's gpus and inserts them in database, or lets them back into placement
+func RegisterGpuNode(clientset *kubernetes.Clientset, rs store.ResourceStore, node *corev1.Node) {
+	results, err := rs.ListResources()
+	if err != nil {
+		log.Printf("[ERROR] Fail to get resource: %v", err)
+		return
+	}
+
+	for _, result := range results {
+		if result.NodeName == node.Name {
+			err = rs.SetSchedulable(node.Name, true)
+			if err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+			return
+		}
+	}
+
+	log.Printf("[INFO] GPU nodes detected and insert gpu resources in database...")
+
+	// Insert gpu resources in database
+	// Get New gpu node's ip & password
+	ip := GetNodeIP(node)
+	foundSecret, err := WaitForSecret(clientset, node.Name)
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		return
+	}
+
+	devices, err := nvidia.DiscoverGPUs(ip, foundSecret)
+	if err != nil {
+		log.Printf("[ERROR] Fail: %v", err)
+		return
+	}
+
+	err = rs.InsertResource(node.Name, devices)
+	if err != nil {
+		log.Printf("[ERROR] Failed to insert gpu resource: %v", err)
+	}
+}
+
+func CreateNodeInformer(clientset *kubernetes.Clientset, rs store.ResourceStore) cache.SharedInformer {
 	// Get exist node list
 	err := LoadExistingNodes(clientset)
 	if err != nil {
@@ -87,7 +129,7 @@ func CreateNodeInformer(clientset *kubernetes.Clientset) cache.SharedInformer {
 	}
 
 	// Create K8S Informer
-	factory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
+	factory := informers.NewSharedInformerFactory(clientset, time.Duration(conf.Get().Resync.Nodes))
 	informer := factory.Core().V1().Nodes().Informer()
 
 	// Define event handlers
@@ -101,26 +143,61 @@ func CreateNodeInformer(clientset *kubernetes.Clientset) cache.SharedInformer {
 				existingNodes[node.Name] = struct{}{}
 
 				if IsGpuShareNode(node) {
-					log.Printf("[INFO] GPU nodes detected and insert gpu resources in database...")
-
-					// Insert gpu resources in database
-					// Get New gpu node's ip & password
-					ip := GetNodeIP(node)
-					foundSecret := WaitForSecret(clientset, node.Name)
-
-					ids, vram, err := nvidia.GetGPUMemoryPerIndex(ip, foundSecret)
-					if err != nil {
-						log.Printf("[ERROR] Fail: %v", err)
-					}
-
-					err = mysql.InsertNewResource(clientset, node.Name, ids, vram)
-					if err != nil {
-						log.Printf("[ERROR] Failed to insert gpu resource: %v", err)
-					}
+					// Waiting for node's secret takes a while, don't block the informer
+					go RegisterGpuNode(clientset, rs, node)
+				}
+			} else if IsGpuShareNode(node) {
+				// Label could have been added while manager was down, or its gpus never got discovered
+				go RegisterGpuNode(clientset, rs, node)
+			} else {
+				// Label could have been removed while manager was down
+				err := rs.SetSchedulable(node.Name, false)
+				if err != nil {
+					log.Printf("[ERROR] %v", err)
 				}
 			}
 		},
-		// Optionally handle UpdateFunc and DeleteFunc
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode := oldObj.(*corev1.Node)
+			newNode := newObj.(*corev1.Node)
+
+			if !IsGpuShareNode(oldNode) && IsGpuShareNode(newNode) {
+				log.Printf("[INFO] Node %s is labeled gpushare=true", newNode.Name)
+				go RegisterGpuNode(clientset, rs, newNode)
+			} else if IsGpuShareNode(oldNode) && !IsGpuShareNode(newNode) {
+				// Pods already placed keep running, so their vram stays accounted
+				log.Printf("[INFO] Node %s lost gpushare label, its gpus are unschedulable", newNode.Name)
+
+				err := rs.SetSchedulable(newNode.Name, false)
+				if err != nil {
+					log.Printf("[ERROR] %v", err)
+				}
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			node, ok := obj.(*corev1.Node)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					return
+				}
+				node, ok = tombstone.Obj.(*corev1.Node)
+				if !ok {
+					return
+				}
+			}
+
+			mu.Lock()
+			delete(existingNodes, node.Name)
+			mu.Unlock()
+
+			log.Printf("[INFO] Node %s deleted, remove its gpu resources", node.Name)
+
+			err := rs.RemoveNode(node.Name)
+			if err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+		},
 	})
 
 	return informer
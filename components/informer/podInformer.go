@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,7 +15,8 @@ import (
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-	"resourceManager/utils/mysql"
+	"resourceManager/conf"
+	"resourceManager/utils/store"
 )
 
 var (
@@ -20,77 +24,200 @@ var (
 	cacheMutex     sync.Mutex
 )
 
+// GetVRAMFromPod returns pod's vram in MiB, from its exact annotation or else its aliyun.com/gpu-mem limit
 func GetVRAMFromPod(pod *corev1.Pod) (int, error) {
+	if value, ok := pod.Annotations["XRCLOUD_GPU_MEM_MIB"]; ok {
+		vram, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("[ERROR] Invalid annotation XRCLOUD_GPU_MEM_MIB %q in pod %s", value, pod.Name)
+		}
+		return vram, nil
+	}
+
 	for _, container := range pod.Spec.Containers {
 		if gpuMem, ok := container.Resources.Limits[corev1.ResourceName("aliyun.com/gpu-mem")]; ok {
 			quantityValue := gpuMem.Value()
-			return int(quantityValue), nil
+			return conf.FromDevicePluginUnit(int(quantityValue)), nil
 		}
 	}
 
 	return 0, fmt.Errorf("[ERROR] Resource gpu-mem not found in any container")
 }
 
-func CreatePodInformer(clientset *kubernetes.Clientset) cache.SharedInformer {
-	// Create K8S Informer
-	factory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
-	informer := factory.Core().V1().Pods().Informer()
+func GetGPUIndexFromPod(pod *corev1.Pod) (string, error) {
+	gpuIndex, ok := pod.Annotations["ALIYUN_COM_GPU_MEM_IDX"]
+	if !ok || gpuIndex == "" {
+		return "", fmt.Errorf("[ERROR] Annotation ALIYUN_COM_GPU_MEM_IDX not found in pod %s", pod.Name)
+	}
+
+	return gpuIndex, nil
+}
+
+// GetGPUIndexesFromPod returns every gpu of multi-gpu pods, or the single one of the others
+func GetGPUIndexesFromPod(pod *corev1.Pod) ([]string, error) {
+	if list, ok := pod.Annotations["XRCLOUD_GPU_MEM_IDX_LIST"]; ok && list != "" {
+		return strings.Split(list, ","), nil
+	}
+
+	gpuIndex, err := GetGPUIndexFromPod(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{gpuIndex}, nil
+}
+
+// GetImageFromPod returns image of pod's first container, which is the one the manager creates
+func GetImageFromPod(pod *corev1.Pod) string {
+	if len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+
+	return pod.Spec.Containers[0].Image
+}
+
+func IsTerminated(pod *corev1.Pod) bool {
+	// Evicted pods end up Failed as well
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+// ReleasePod returns pod's vram, it's safe to call as many times as pod's events arrive
+func ReleasePod(rs store.ResourceStore, pod *corev1.Pod, onRelease func()) {
+	// Return exactly what the ledger recorded for this pod, not for a newer one of its name.
+	// History keeps the phase it ended with
+	allocations, err := rs.Release(pod.Namespace, pod.Name, string(pod.UID), string(pod.Status.Phase))
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		return
+	}
+
+	if len(allocations) == 0 {
+		return
+	}
+
+	gpuIndexes, _ := GetGPUIndexesFromPod(pod)
+
+	for _, allocation := range allocations {
+		if gpuIndexes != nil && !slices.Contains(gpuIndexes, allocation.GPUIndex) {
+			log.Printf("[ERROR] Pod %s runs on gpu %s, but gpu %s was recorded", pod.Name, strings.Join(gpuIndexes, ","), allocation.GPUIndex)
+		}
+
+		log.Printf("[INFO] Returned %d MiB vram of pod %s on [%s]'s gpu %s", allocation.VRAM, pod.Name, allocation.NodeName, allocation.GPUIndex)
+	}
+
+	if onRelease != nil {
+		onRelease()
+	}
+}
+
+// GpuShareSelector selects the pods resource manager places
+const GpuShareSelector = "app=gpushare"
+
+// ListGpuSharePods lists gpushare pods of every managed namespace
+func ListGpuSharePods(clientset *kubernetes.Clientset) ([]corev1.Pod, error) {
+	var pods []corev1.Pod
+	for _, namespace := range conf.ManagedNamespaces() {
+		list, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
+			LabelSelector: GpuShareSelector,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to list pods in namespace %s: %w", namespace, err)
+		}
+
+		pods = append(pods, list.Items...)
+	}
+
+	return pods, nil
+}
 
+// CreatePodInformers watches gpushare pods with an informer per managed namespace, so nothing else in the cluster is listed.
+// onRelease is called whenever a finished pod's vram is returned
+func CreatePodInformers(clientset *kubernetes.Clientset, rs store.ResourceStore, onRelease func()) []cache.SharedInformer {
+	handler := podEventHandler(clientset, rs, onRelease)
+
+	var podInformers []cache.SharedInformer
+	for _, namespace := range conf.ManagedNamespaces() {
+		// Create K8S Informer
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset, time.Duration(conf.Get().Resync.Pods),
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = GpuShareSelector
+			}),
+		)
+		informer := factory.Core().V1().Pods().Informer()
+		informer.AddEventHandler(handler)
+
+		podInformers = append(podInformers, informer)
+	}
+
+	return podInformers
+}
+
+func podEventHandler(clientset *kubernetes.Clientset, rs store.ResourceStore, onRelease func()) cache.ResourceEventHandler {
 	// Define event handlers
-	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			pod := obj.(*corev1.Pod)
-			if pod.Namespace == namespace {
-				log.Printf("[INFO] Pod added in namespace %s: %s\n", namespace, pod.Name)
+			if conf.IsManagedNamespace(pod.Namespace) {
+				log.Printf("[INFO] Pod added in namespace %s: %s\n", pod.Namespace, pod.Name)
 			}
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			pod := newObj.(*corev1.Pod)
+			if !conf.IsManagedNamespace(pod.Namespace) {
+				return
+			}
 
 			cacheMutex.Lock()
 			defer cacheMutex.Unlock()
 
-			oldPhase, exists := podStatusCache[pod.Name]
+			key := pod.Namespace + "/" + pod.Name
+			oldPhase, exists := podStatusCache[key]
 
 			if !exists || oldPhase != pod.Status.Phase {
-				if pod.Namespace == namespace && pod.Status.Phase == corev1.PodSucceeded {
-					log.Printf("[INFO] Pod completed in namespace %s: %s\n", namespace, pod.Name)
-
-					gpuMem, err := GetVRAMFromPod(pod)
-					if err != nil {
-						log.Printf("[ERROR] Error getting vram: %v", err)
-					}
-
-					err = clientset.CoreV1().Pods(namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
-					if err != nil {
-						log.Printf("[ERROR] Error deleting pod %s: %v", pod.Name, err)
-					} else {
-						log.Printf("[INFO] Pod %s deleted successfully\n", pod.Name)
-					}
-
-					results, err := mysql.GetAvailableResource(clientset)
-					if err != nil {
-						log.Printf("[ERROR] Fail to get resource: %v", err)
-					}
-
-					for _, result := range results {
-						if result["gpu_index"].(string) == "0" && result["node_name"].(string) == pod.Spec.NodeName {
-							if result["vram_remain"].(int) != result["total_vram"].(int) {
-								err = mysql.ReturnResource(clientset, result["node_name"].(string), result["gpu_index"].(string), result["vram_usage"].(int), result["vram_remain"].(int), result["is_available"].(int), gpuMem)
-								if err != nil {
-									log.Printf("[ERROR] %v", err)
-									break
-								}
-								break
-							}
+				if IsTerminated(pod) {
+					log.Printf("[INFO] Pod %s in namespace %s: %s (%s)\n", pod.Status.Phase, pod.Namespace, pod.Name, pod.Status.Reason)
+
+					ReleasePod(rs, pod, onRelease)
+
+					// Failed pods are kept for inspection, their vram is returned anyway
+					if pod.Status.Phase == corev1.PodSucceeded {
+						err := clientset.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
+						if err != nil {
+							log.Printf("[ERROR] Error deleting pod %s: %v", pod.Name, err)
+						} else {
+							log.Printf("[INFO] Pod %s deleted successfully\n", pod.Name)
 						}
 					}
 				}
 
-				podStatusCache[pod.Name] = pod.Status.Phase
+				podStatusCache[key] = pod.Status.Phase
 			}
 		},
-	})
+		DeleteFunc: func(obj interface{}) {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					return
+				}
+				pod, ok = tombstone.Obj.(*corev1.Pod)
+				if !ok {
+					return
+				}
+			}
 
-	return informer
+			if !conf.IsManagedNamespace(pod.Namespace) {
+				return
+			}
+
+			log.Printf("[INFO] Pod deleted in namespace %s: %s\n", pod.Namespace, pod.Name)
+
+			ReleasePod(rs, pod, onRelease)
+
+			cacheMutex.Lock()
+			delete(podStatusCache, pod.Namespace+"/"+pod.Name)
+			cacheMutex.Unlock()
+		},
+	}
 }
@@ -0,0 +1,80 @@
+package informer
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"resourceManager/conf"
+	"resourceManager/utils/store"
+)
+
+func TestReleasePodOnce(t *testing.T) {
+	rs := store.NewMemoryStore()
+	if err := rs.InsertResource("node-a", []conf.GPUDevice{{Index: "0", MemoryMiB: 24576}}); err != nil {
+		t.Fatalf("InsertResource: %v", err)
+	}
+	if _, err := rs.Allocate("pod", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 8192); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod",
+			Namespace:   "xrcloud",
+			Annotations: map[string]string{"ALIYUN_COM_GPU_MEM_IDX": "0", "XRCLOUD_GPU_MEM_MIB": "8192"},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodSucceeded},
+	}
+
+	// Update and delete events of the same pod, and a resync, all try to release it
+	released := 0
+	for i := 0; i < 3; i++ {
+		ReleasePod(rs, pod, func() { released++ })
+	}
+
+	if released != 1 {
+		t.Errorf("onRelease called %d times, want 1", released)
+	}
+
+	results, _ := rs.ListResources()
+	if results[0].VRAMUsage != 0 || results[0].VRAMRemain != 24576 {
+		t.Errorf("gpu 0: usage %d, remain %d after release", results[0].VRAMUsage, results[0].VRAMRemain)
+	}
+}
+
+func TestGetVRAMFromPod(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		limit       string
+		want        int
+		wantErr     bool
+	}{
+		{name: "annotation", annotations: map[string]string{"XRCLOUD_GPU_MEM_MIB": "1536"}, limit: "2", want: 1536},
+		{name: "limit in GiB", limit: "3", want: 3072},
+		{name: "invalid annotation", annotations: map[string]string{"XRCLOUD_GPU_MEM_MIB": "lots"}, wantErr: true},
+		{name: "no gpu-mem", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Annotations: tt.annotations}}
+
+			container := corev1.Container{Name: "main"}
+			if tt.limit != "" {
+				container.Resources.Limits = corev1.ResourceList{"aliyun.com/gpu-mem": resource.MustParse(tt.limit)}
+			}
+			pod.Spec.Containers = []corev1.Container{container}
+
+			vram, err := GetVRAMFromPod(pod)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetVRAMFromPod error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if vram != tt.want {
+				t.Errorf("GetVRAMFromPod = %d, want %d", vram, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package leaderElection
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"resourceManager/conf"
+)
+
+var (
+	// ready is set once the leader finished starting up, writes are only served from then on
+	ready   atomic.Bool
+	elector atomic.Pointer[leaderelection.LeaderElector]
+)
+
+// Identity is this replica's name in the lease, the pod name when running in cluster
+func Identity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Sprintf("resource-manager-%d", os.Getpid())
+	}
+	return hostname
+}
+
+func IsLeader() bool {
+	return ready.Load()
+}
+
+// Run blocks campaigning for the lease, onStartedLeading is run once it's acquired.
+// Leadership is never given back while running, losing it exits the process so no stale state is kept
+func Run(ctx context.Context, clientset *kubernetes.Clientset, settings conf.Settings, onStartedLeading func(ctx context.Context)) error {
+	election := settings.LeaderElection
+	identity := Identity()
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      election.LeaseName,
+			Namespace: settings.Namespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   time.Duration(election.LeaseDuration),
+		RenewDeadline:   time.Duration(election.RenewDeadline),
+		RetryPeriod:     time.Duration(election.RetryPeriod),
+		ReleaseOnCancel: true,
+		Name:            election.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("[INFO] %s became leader", identity)
+				onStartedLeading(ctx)
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() != nil {
+					log.Printf("[INFO] %s released leadership", identity)
+					return
+				}
+				log.Fatalf("[ERROR] %s lost leadership", identity)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Printf("[INFO] %s is following leader %s", identity, leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to create leader elector: %w", err)
+	}
+
+	elector.Store(le)
+	le.Run(ctx)
+
+	return nil
+}
+
+// SetReady marks this replica as the leader able to serve writes
+func SetReady() {
+	ready.Store(true)
+}
+
+// LeaderOnly serves the handler on the leader, followers forward the request to the leader's pod
+func LeaderOnly(clientset *kubernetes.Clientset, handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if IsLeader() {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		leader := ""
+		if le := elector.Load(); le != nil {
+			leader = le.GetLeader()
+		}
+
+		if leader == "" || leader == Identity() {
+			http.Error(w, "[ERROR] No leader is ready yet, retry later", http.StatusServiceUnavailable)
+			return
+		}
+
+		target, err := leaderURL(clientset, leader)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, fmt.Sprintf("[ERROR] Failed to forward request to leader %s: %v", leader, err), http.StatusBadGateway)
+		}
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// leaderURL finds the leader's pod, its name is the leader's identity
+func leaderURL(clientset *kubernetes.Clientset, leader string) (*url.URL, error) {
+	settings := conf.Get()
+
+	pod, err := clientset.CoreV1().Pods(settings.Namespace).Get(context.TODO(), leader, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to find leader %s: %w", leader, err)
+	}
+
+	if pod.Status.PodIP == "" {
+		return nil, fmt.Errorf("[ERROR] Leader %s has no pod ip", leader)
+	}
+
+	return &url.URL{Scheme: "http", Host: fmt.Sprintf("%s:%d", pod.Status.PodIP, settings.Port)}, nil
+}
@@ -0,0 +1,219 @@
+package reconciler
+
+import (
+	"log"
+	"maps"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"resourceManager/components/deployManager"
+	"resourceManager/components/informer"
+	"resourceManager/components/tenantManager"
+	"resourceManager/conf"
+	"resourceManager/utils/metrics"
+	"resourceManager/utils/store"
+)
+
+// Allocations younger than this may belong to a pod which is being created right now
+var GracePeriod = time.Minute
+
+type gpuKey struct {
+	nodeName string
+	gpuIndex string
+}
+
+type podKey struct {
+	namespace string
+	podName   string
+}
+
+// Reconcile rebuilds gpu usage from the gpushare pods actually running,
+// then fixes the ledger and gpuResource where they drifted. onRelease is called when vram was freed
+func Reconcile(clientset *kubernetes.Clientset, rs store.ResourceStore, onRelease func()) error {
+	metrics.Add(metrics.Series("resource_manager_reconcile_runs_total"), 1)
+
+	// Firstly, list live pods, before allocations, so a pod being placed is always seen with its allocation
+	pods, err := informer.ListGpuSharePods(clientset)
+	if err != nil {
+		return err
+	}
+
+	allocations, err := rs.ListAllocations()
+	if err != nil {
+		return err
+	}
+
+	results, err := rs.ListResources()
+	if err != nil {
+		return err
+	}
+
+	// vram ledger holds for each pod, per gpu
+	recorded := make(map[podKey]map[string]int)
+	// pods whose allocations should have been bound to them by now
+	unbound := make(map[podKey]bool)
+	for _, allocation := range allocations {
+		key := podKey{allocation.Namespace, allocation.PodName}
+		if recorded[key] == nil {
+			recorded[key] = make(map[string]int)
+		}
+		recorded[key][allocation.GPUIndex] += allocation.VRAM
+
+		if allocation.PodUID == "" && time.Since(allocation.CreatedAt) >= GracePeriod {
+			unbound[key] = true
+		}
+	}
+
+	// Secondly, rebuild usage from pods' limits and annotations, adopting the ones missing in ledger
+	// and correcting the ones ledger holds other vram for
+	expected := make(map[gpuKey]int)
+	live := make(map[podKey]bool)
+	corrections := 0
+	released := false
+
+	for i := range pods {
+		pod := &pods[i]
+		if !conf.IsManagedNamespace(pod.Namespace) || pod.Spec.NodeName == "" || informer.IsTerminated(pod) {
+			continue
+		}
+
+		key := podKey{pod.Namespace, pod.Name}
+
+		// Terminating pods are never adopted, a preempted victim's vram already belongs to its preemptor.
+		// The ones still in ledger keep their vram until informer sees them gone
+		if pod.DeletionTimestamp != nil {
+			if ledger, ok := recorded[key]; ok {
+				live[key] = true
+				for gpuIndex, held := range ledger {
+					expected[gpuKey{pod.Spec.NodeName, gpuIndex}] += held
+				}
+			}
+			continue
+		}
+
+		gpuIndexes, err := informer.GetGPUIndexesFromPod(pod)
+		if err != nil {
+			log.Printf("[ERROR] %v", err)
+			continue
+		}
+
+		vram, err := informer.GetVRAMFromPod(pod)
+		if err != nil {
+			log.Printf("[ERROR] %v", err)
+			continue
+		}
+
+		// Multi-gpu pods' limit covers all of their gpus evenly
+		vramPerGPU := vram / len(gpuIndexes)
+
+		live[key] = true
+
+		tenant := pod.Labels[tenantManager.TenantLabel]
+		if tenant == "" {
+			tenant = tenantManager.DefaultTenant
+		}
+
+		actual := make(map[string]int)
+		for _, gpuIndex := range gpuIndexes {
+			expected[gpuKey{pod.Spec.NodeName, gpuIndex}] += vramPerGPU
+			actual[gpuIndex] += vramPerGPU
+		}
+
+		ledger, ok := recorded[key]
+		if ok && maps.Equal(ledger, actual) {
+			if unbound[key] {
+				if err = rs.BindPod(pod.Namespace, pod.Name, string(pod.UID)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if ok {
+			log.Printf("[INFO] Pod %s uses %v MiB vram on [%s]'s gpus, but ledger holds %v, correcting it", pod.Name, actual, pod.Spec.NodeName, ledger)
+
+			if _, err = rs.Release(pod.Namespace, pod.Name, "", store.PhaseReconciled); err != nil {
+				return err
+			}
+			// Pod may use less than ledger held, queue is woken up for what's freed
+			released = true
+		} else {
+			log.Printf("[INFO] Pod %s uses %v MiB vram on [%s]'s gpus without allocation, adopting it", pod.Name, actual, pod.Spec.NodeName)
+		}
+
+		for _, gpuIndex := range gpuIndexes {
+			if err = rs.Record(pod.Name, pod.Namespace, tenant, informer.GetImageFromPod(pod), pod.Spec.NodeName, gpuIndex, vramPerGPU); err != nil {
+				return err
+			}
+		}
+		if err = rs.BindPod(pod.Namespace, pod.Name, string(pod.UID)); err != nil {
+			return err
+		}
+		corrections++
+	}
+
+	// Thirdly, release allocations whose pod is gone
+	for _, allocation := range allocations {
+		key := podKey{allocation.Namespace, allocation.PodName}
+		if live[key] {
+			continue
+		}
+
+		// Reservations of groups still gathering their members have no pod yet
+		if time.Since(allocation.CreatedAt) < GracePeriod || deployManager.IsReserved(allocation.Namespace, allocation.PodName) {
+			expected[gpuKey{allocation.NodeName, allocation.GPUIndex}] += allocation.VRAM
+			continue
+		}
+
+		log.Printf("[INFO] Pod %s is gone but holds %d MiB vram on [%s]'s gpu %s, releasing it", allocation.PodName, allocation.VRAM, allocation.NodeName, allocation.GPUIndex)
+
+		if _, err = rs.Release(allocation.Namespace, allocation.PodName, "", store.PhaseGone); err != nil {
+			return err
+		}
+		corrections++
+		released = true
+	}
+
+	// Lastly, report drift of every gpu and correct gpuResource from ledger
+	for _, result := range results {
+		drift := result.VRAMUsage - expected[gpuKey{result.NodeName, result.GPUIndex}]
+
+		metrics.Set(metrics.Series("resource_manager_reconcile_drift_vram", "node", result.NodeName, "gpu", result.GPUIndex), float64(drift))
+
+		if drift != 0 {
+			log.Printf("[INFO] GPU %s of [%s] drifted by %d MiB vram, correcting it", result.GPUIndex, result.NodeName, drift)
+			corrections++
+		}
+	}
+
+	if err = rs.RecomputeUsage(); err != nil {
+		return err
+	}
+
+	metrics.Add(metrics.Series("resource_manager_reconcile_corrections_total"), float64(corrections))
+
+	log.Printf("[INFO] Reconcile gpu resources, successfully (%d corrections)", corrections)
+
+	if released && onRelease != nil {
+		onRelease()
+	}
+
+	return nil
+}
+
+func RunReconciler(clientset *kubernetes.Clientset, rs store.ResourceStore, period time.Duration, onRelease func(), stopCh <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := Reconcile(clientset, rs, onRelease); err != nil {
+				log.Printf("[ERROR] Failed to reconcile: %v", err)
+				metrics.Add(metrics.Series("resource_manager_reconcile_errors_total"), 1)
+			}
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package tenantManager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"resourceManager/conf"
+	"resourceManager/utils/store"
+)
+
+const (
+	// Requests without tenant are charged to DefaultTenant
+	DefaultTenant = "default"
+	TenantLabel   = "tenant"
+)
+
+var (
+	ErrQuotaExceeded   = errors.New("[ERROR] Tenant quota exceeded")
+	ErrRequestTooLarge = errors.New("[ERROR] Request exceeds tenant's vram per pod")
+	ErrUnknownTenant   = errors.New("[ERROR] Tenant has no quota")
+
+	quotas     = make(map[string]conf.TenantQuota)
+	quotaMutex sync.RWMutex
+
+	locks     = make(map[string]*sync.Mutex)
+	lockMutex sync.Mutex
+
+	// pendingRequests are admitted already, but hold no vram yet, e.g. members of groups still gathering
+	pendingRequests func() []conf.PodCreationRequest
+)
+
+func TenantOf(req conf.PodCreationRequest) string {
+	if req.Tenant == "" {
+		return DefaultTenant
+	}
+	return req.Tenant
+}
+
+func SetQuotas(list []conf.TenantQuota) error {
+	loaded := make(map[string]conf.TenantQuota)
+	for _, quota := range list {
+		if quota.Name == "" {
+			return errors.New("[ERROR] Tenant quota without name")
+		}
+		if quota.MaxVRAM < 0 || quota.MaxPods < 0 || quota.MaxVRAMPerPod < 0 {
+			return fmt.Errorf("[ERROR] Tenant %s has negative quota", quota.Name)
+		}
+		loaded[quota.Name] = quota
+	}
+
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+
+	quotas = loaded
+
+	return nil
+}
+
+func GetQuota(tenant string) conf.TenantQuota {
+	quota, _ := lookupQuota(tenant)
+	return quota
+}
+
+// lookupQuota tells whether tenant may be admitted, which are all tenants until any quota is configured
+func lookupQuota(tenant string) (conf.TenantQuota, bool) {
+	quotaMutex.RLock()
+	defer quotaMutex.RUnlock()
+
+	quota, ok := quotas[tenant]
+	if !ok {
+		return conf.TenantQuota{Name: tenant}, len(quotas) == 0
+	}
+
+	return quota, true
+}
+
+// Lock serializes admission and placement of the tenants, so concurrent requests can't both slip under quota
+func Lock(tenants ...string) func() {
+	sorted := append([]string(nil), tenants...)
+	sort.Strings(sorted)
+
+	var held []*sync.Mutex
+
+	lockMutex.Lock()
+	for i, tenant := range sorted {
+		if i > 0 && tenant == sorted[i-1] {
+			continue
+		}
+		if locks[tenant] == nil {
+			locks[tenant] = &sync.Mutex{}
+		}
+		held = append(held, locks[tenant])
+	}
+	lockMutex.Unlock()
+
+	for _, lock := range held {
+		lock.Lock()
+	}
+
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+		}
+	}
+}
+
+// SetPendingRequests lets GetUsage count requests which were admitted but aren't allocated yet
+func SetPendingRequests(fn func() []conf.PodCreationRequest) {
+	pendingRequests = fn
+}
+
+// GetUsage sums up vram and pods of every tenant from outstanding allocations and pending requests
+func GetUsage(rs store.ResourceStore) (map[string]conf.TenantUsage, error) {
+	// Pending requests are gathered first, one allocated meanwhile is counted twice rather than not at all
+	var pending []conf.PodCreationRequest
+	if pendingRequests != nil {
+		pending = pendingRequests()
+	}
+
+	allocations, err := rs.ListAllocations()
+	if err != nil {
+		return nil, err
+	}
+
+	usages := make(map[string]conf.TenantUsage)
+	pods := make(map[string]bool)
+
+	quotaMutex.RLock()
+	for name, quota := range quotas {
+		usages[name] = conf.TenantUsage{Name: name, Quota: quota}
+	}
+	quotaMutex.RUnlock()
+
+	for _, allocation := range allocations {
+		tenant := allocation.Tenant
+		if tenant == "" {
+			tenant = DefaultTenant
+		}
+
+		usage, ok := usages[tenant]
+		if !ok {
+			usage = conf.TenantUsage{Name: tenant, Quota: GetQuota(tenant)}
+		}
+
+		usage.VRAM += allocation.VRAM
+
+		podKey := allocation.Namespace + "/" + allocation.PodName
+		if !pods[podKey] {
+			pods[podKey] = true
+			usage.Pods++
+		}
+
+		usages[tenant] = usage
+	}
+
+	for _, req := range pending {
+		tenant := TenantOf(req)
+
+		usage, ok := usages[tenant]
+		if !ok {
+			usage = conf.TenantUsage{Name: tenant, Quota: GetQuota(tenant)}
+		}
+
+		usage.VRAM += req.VRAMPerDevice() * req.GPUCount()
+		usage.Pods++
+
+		usages[tenant] = usage
+	}
+
+	return usages, nil
+}
+
+// Admit checks the requests against their tenants' quotas, as if all of them were placed together.
+// Once quotas are configured, tenants without one are rejected, so a made up or missing tenant doesn't skip its quota
+func Admit(rs store.ResourceStore, reqs []conf.PodCreationRequest) error {
+	for _, req := range reqs {
+		if _, ok := lookupQuota(TenantOf(req)); !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownTenant, TenantOf(req))
+		}
+	}
+
+	usages, err := GetUsage(rs)
+	if err != nil {
+		return err
+	}
+
+	for _, req := range reqs {
+		tenant := TenantOf(req)
+		quota := GetQuota(tenant)
+		vram := req.VRAMPerDevice() * req.GPUCount()
+
+		if quota.MaxVRAMPerPod > 0 && vram > quota.MaxVRAMPerPod.MiB() {
+			return fmt.Errorf("%w: pod %s requests %s vram, tenant %s allows %s", ErrRequestTooLarge, req.PodName, conf.VRAM(vram), tenant, quota.MaxVRAMPerPod)
+		}
+
+		usage := usages[tenant]
+		usage.VRAM += vram
+		usage.Pods++
+
+		if quota.MaxVRAM > 0 && usage.VRAM > quota.MaxVRAM.MiB() {
+			return fmt.Errorf("%w: tenant %s would use %s of %s vram", ErrQuotaExceeded, tenant, conf.VRAM(usage.VRAM), quota.MaxVRAM)
+		}
+
+		if quota.MaxPods > 0 && usage.Pods > quota.MaxPods {
+			return fmt.Errorf("%w: tenant %s would run %d of %d pods", ErrQuotaExceeded, tenant, usage.Pods, quota.MaxPods)
+		}
+
+		usages[tenant] = usage
+	}
+
+	return nil
+}
+
+// AdmissionStatus maps admission errors to http status, 403 for requests never allowed, 429 for the ones over quota now
+func AdmissionStatus(err error) int {
+	if errors.Is(err, ErrRequestTooLarge) || errors.Is(err, ErrUnknownTenant) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+func ListUsageHandler(rs store.ResourceStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		usages, err := GetUsage(rs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("[ERROR] Failed to get tenant usage: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		list := []conf.TenantUsage{}
+		for _, usage := range usages {
+			list = append(list, usage)
+		}
+
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Name < list[j].Name
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+func GetUsageHandler(rs store.ResourceStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		usages, err := GetUsage(rs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("[ERROR] Failed to get tenant usage: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		name := r.PathValue("name")
+		usage, ok := usages[name]
+		if !ok {
+			usage = conf.TenantUsage{Name: name, Quota: GetQuota(name)}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+	}
+}
@@ -0,0 +1,108 @@
+package tenantManager
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"resourceManager/conf"
+	"resourceManager/utils/store"
+)
+
+func newTestStore(t *testing.T) *store.MemoryStore {
+	t.Helper()
+
+	rs := store.NewMemoryStore()
+	devices := []conf.GPUDevice{{Index: "0", MemoryMiB: 24576}, {Index: "1", MemoryMiB: 24576}}
+	if err := rs.InsertResource("node-a", devices); err != nil {
+		t.Fatalf("InsertResource: %v", err)
+	}
+
+	return rs
+}
+
+func request(name string, tenant string, vram int) conf.PodCreationRequest {
+	return conf.PodCreationRequest{PodName: name, Image: "busybox", VRAMReq: conf.VRAM(vram), Tenant: tenant}
+}
+
+func TestAdmit(t *testing.T) {
+	if err := SetQuotas([]conf.TenantQuota{
+		{Name: "team", MaxVRAM: conf.VRAM(8192), MaxPods: 2, MaxVRAMPerPod: conf.VRAM(6144)},
+		{Name: DefaultTenant, MaxVRAM: conf.VRAM(2048)},
+	}); err != nil {
+		t.Fatalf("SetQuotas: %v", err)
+	}
+	defer SetQuotas(nil)
+
+	rs := newTestStore(t)
+	if _, err := rs.Allocate("running", "xrcloud", "team", "busybox", "node-a", []string{"0"}, 4096); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		reqs       []conf.PodCreationRequest
+		wantErr    error
+		wantStatus int
+	}{
+		{name: "within quota", reqs: []conf.PodCreationRequest{request("a", "team", 4096)}},
+		{name: "over vram", reqs: []conf.PodCreationRequest{request("a", "team", 5120)}, wantErr: ErrQuotaExceeded, wantStatus: http.StatusTooManyRequests},
+		{name: "over pods together", reqs: []conf.PodCreationRequest{request("a", "team", 1024), request("b", "team", 1024)}, wantErr: ErrQuotaExceeded, wantStatus: http.StatusTooManyRequests},
+		{name: "over vram per pod", reqs: []conf.PodCreationRequest{request("a", "team", 7168)}, wantErr: ErrRequestTooLarge, wantStatus: http.StatusForbidden},
+		{name: "made up tenant", reqs: []conf.PodCreationRequest{request("a", "x", 1024)}, wantErr: ErrUnknownTenant, wantStatus: http.StatusForbidden},
+		{name: "made up tenant in a group", reqs: []conf.PodCreationRequest{request("a", "team", 1024), request("b", "x", 1024)}, wantErr: ErrUnknownTenant, wantStatus: http.StatusForbidden},
+		{name: "missing tenant is default", reqs: []conf.PodCreationRequest{request("a", "", 2048)}},
+		{name: "missing tenant over default quota", reqs: []conf.PodCreationRequest{request("a", "", 3072)}, wantErr: ErrQuotaExceeded, wantStatus: http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		err := Admit(rs, test.reqs)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: Admit error = %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if err != nil && AdmissionStatus(err) != test.wantStatus {
+			t.Errorf("%s: AdmissionStatus = %d, want %d", test.name, AdmissionStatus(err), test.wantStatus)
+		}
+	}
+}
+
+func TestAdmitWithoutQuotas(t *testing.T) {
+	if err := SetQuotas(nil); err != nil {
+		t.Fatalf("SetQuotas: %v", err)
+	}
+
+	// Until quotas are configured every tenant is unlimited
+	rs := newTestStore(t)
+	if err := Admit(rs, []conf.PodCreationRequest{request("a", "anyone", 49152), request("b", "", 1024)}); err != nil {
+		t.Errorf("Admit: %v", err)
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	if err := SetQuotas([]conf.TenantQuota{{Name: "team", MaxVRAM: conf.VRAM(8192)}}); err != nil {
+		t.Fatalf("SetQuotas: %v", err)
+	}
+	defer SetQuotas(nil)
+
+	rs := newTestStore(t)
+	// A two gpu pod is one pod of its tenant
+	if _, err := rs.Allocate("pair", "xrcloud", "team", "busybox", "node-a", []string{"0", "1"}, 2048); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if _, err := rs.Allocate("other", "xrcloud", "", "busybox", "node-a", []string{"0"}, 1024); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	usages, err := GetUsage(rs)
+	if err != nil {
+		t.Fatalf("GetUsage: %v", err)
+	}
+
+	if usage := usages["team"]; usage.VRAM != 4096 || usage.Pods != 1 || usage.Quota.MaxVRAM != 8192 {
+		t.Errorf("team = %+v, want 4096 MiB in 1 pod of 8192 MiB quota", usage)
+	}
+	if usage := usages[DefaultTenant]; usage.VRAM != 1024 || usage.Pods != 1 {
+		t.Errorf("default = %+v, want 1024 MiB in 1 pod", usage)
+	}
+}
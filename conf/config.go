@@ -1,5 +1,7 @@
 package conf
 
+import "time"
+
 type GPUNodeAddr struct {
 	IPAddr   string
 	Password string
@@ -7,7 +9,131 @@ type GPUNodeAddr struct {
 }
 
 type PodCreationRequest struct {
-	PodName string `json:"name"`
-	Image   string `json:"image"`
-	VRAMReq int    `json:"vram"`
+	PodName       string `json:"name"`
+	Image         string `json:"image"`
+	VRAMReq       VRAM   `json:"vram"`                 // total vram, split evenly across gpus
+	GPUs          int    `json:"gpus,omitempty"`       // number of gpus on one node, 1 by default
+	VRAMPerGPU    VRAM   `json:"vramPerGpu,omitempty"` // overrides the even split of vram
+	Policy        string `json:"policy,omitempty"`
+	MaxWait       int    `json:"maxWait,omitempty"`       // seconds to wait in queue when no gpu is free
+	PriorityClass string `json:"priorityClass,omitempty"` // one of priority classes in settings, the default one when empty
+	Preempt       bool   `json:"preempt,omitempty"`       // evict lower priority pods when vram is full, if the class may
+	Tenant        string `json:"tenant,omitempty"`        // user or project charged for the pod
+	Namespace     string `json:"namespace,omitempty"`
+}
+
+// PriorityOf is the request's priority, as its priority class defines it
+func (req PodCreationRequest) PriorityOf() int {
+	class, _ := Get().LookupPriorityClass(req.PriorityClass)
+	return class.Priority
+}
+
+// MayPreempt tells whether the request asks for preemption and its priority class allows it
+func (req PodCreationRequest) MayPreempt() bool {
+	class, ok := Get().LookupPriorityClass(req.PriorityClass)
+	return ok && class.Preempt && req.Preempt
+}
+
+// NamespaceOf is where the pod is created, the default managed namespace unless the request chose one
+func (req PodCreationRequest) NamespaceOf() string {
+	if req.Namespace == "" {
+		return DefaultNamespace()
+	}
+	return req.Namespace
+}
+
+func (req PodCreationRequest) GPUCount() int {
+	if req.GPUs <= 0 {
+		return 1
+	}
+	return req.GPUs
+}
+
+// VRAMPerDevice is the vram in MiB reserved on each of the request's gpus.
+// It's rounded up to device plugin's unit, kubelet charges the pod that much whatever it asked for
+func (req PodCreationRequest) VRAMPerDevice() int {
+	vram := req.VRAMPerGPU.MiB()
+	if vram <= 0 {
+		count := req.GPUCount()
+		vram = (req.VRAMReq.MiB() + count - 1) / count
+	}
+
+	return FromDevicePluginUnit(ToDevicePluginUnit(vram))
+}
+
+// GroupCreationRequest places all of its members, or none of them
+type GroupCreationRequest struct {
+	GroupName string               `json:"name"`
+	Members   []PodCreationRequest `json:"members"`
+	Timeout   int                  `json:"timeout,omitempty"` // seconds to hold partial reservations
+}
+
+// GPUDevice is a gpu as nvidia-smi reports it
+type GPUDevice struct {
+	Index     string `json:"gpu"`
+	UUID      string `json:"uuid"`
+	Model     string `json:"model"`
+	BusID     string `json:"busId"`
+	MemoryMiB int    `json:"memoryMiB"`
+}
+
+// GPUResource's vram is in MiB
+type GPUResource struct {
+	NodeName    string `json:"node"`
+	GPUIndex    string `json:"gpu"`
+	TotalVRAM   int    `json:"totalVram"`
+	VRAMUsage   int    `json:"vramUsage"`
+	VRAMRemain  int    `json:"vramRemain"`
+	IsAvailable bool   `json:"isAvailable"`
+
+	UUID      string `json:"uuid"`
+	Model     string `json:"model"`
+	BusID     string `json:"busId"`
+	MemoryMiB int    `json:"memoryMiB"` // as reported by nvidia-smi
+
+	// GPUs of nodes which lost gpushare label are kept for outstanding allocations, but not scheduled
+	IsSchedulable bool `json:"isSchedulable"`
+}
+
+type Allocation struct {
+	ID        int64  `json:"id"`
+	PodName   string `json:"pod"`
+	Namespace string `json:"namespace"`
+	Tenant    string `json:"tenant,omitempty"`
+	NodeName  string `json:"node"`
+	GPUIndex  string `json:"gpu"`
+	VRAM      int    `json:"vram"`             // MiB
+	PodUID    string `json:"podUid,omitempty"` // empty until the pod is created
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// TenantQuota limits a user's or project's gpu usage, zero means unlimited
+type TenantQuota struct {
+	Name          string `json:"name"`
+	MaxVRAM       VRAM   `json:"maxVram"`
+	MaxPods       int    `json:"maxPods"`
+	MaxVRAMPerPod VRAM   `json:"maxVramPerPod"`
+}
+
+type TenantUsage struct {
+	Name  string      `json:"name"`
+	VRAM  int         `json:"vram"` // MiB
+	Pods  int         `json:"pods"`
+	Quota TenantQuota `json:"quota"`
+}
+
+// AllocationRecord is an allocation's entry in history, it's kept after the pod is gone
+type AllocationRecord struct {
+	AllocationID int64      `json:"allocationId"`
+	PodName      string     `json:"pod"`
+	Namespace    string     `json:"namespace"`
+	Tenant       string     `json:"tenant,omitempty"`
+	Image        string     `json:"image,omitempty"`
+	NodeName     string     `json:"node"`
+	GPUIndex     string     `json:"gpu"`
+	VRAM         int        `json:"vram"` // MiB
+	StartedAt    time.Time  `json:"startedAt"`
+	EndedAt      *time.Time `json:"endedAt,omitempty"` // nil while allocation is outstanding
+	Phase        string     `json:"phase,omitempty"`   // pod's phase when its vram was returned
 }
@@ -0,0 +1,50 @@
+package conf
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	// Pods are only created in, and followed through, these namespaces. The first one is the default
+	managedNamespaces = []string{"xrcloud"}
+	namespaceMutex    sync.RWMutex
+)
+
+func SetManagedNamespaces(namespaces []string) {
+	namespaceMutex.Lock()
+	defer namespaceMutex.Unlock()
+
+	managedNamespaces = nil
+	for _, namespace := range namespaces {
+		namespace = strings.TrimSpace(namespace)
+		if namespace != "" && !slices.Contains(managedNamespaces, namespace) {
+			managedNamespaces = append(managedNamespaces, namespace)
+		}
+	}
+}
+
+func ManagedNamespaces() []string {
+	namespaceMutex.RLock()
+	defer namespaceMutex.RUnlock()
+
+	return slices.Clone(managedNamespaces)
+}
+
+func DefaultNamespace() string {
+	namespaceMutex.RLock()
+	defer namespaceMutex.RUnlock()
+
+	if len(managedNamespaces) == 0 {
+		return ""
+	}
+	return managedNamespaces[0]
+}
+
+func IsManagedNamespace(namespace string) bool {
+	namespaceMutex.RLock()
+	defer namespaceMutex.RUnlock()
+
+	return slices.Contains(managedNamespaces, namespace)
+}
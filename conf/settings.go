@@ -0,0 +1,457 @@
+package conf
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Duration is a time.Duration written as "30s" or "5m" in config file
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(time.Duration(d).String())), nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	value, err := strconv.Unquote(string(data))
+	if err != nil {
+		return fmt.Errorf("duration %s must be a string like \"30s\"", data)
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+type DBSettings struct {
+	Host           string `json:"host"` // host:port of mysql
+	Name           string `json:"name"`
+	User           string `json:"user"`
+	PasswordSecret string `json:"passwordSecret"` // secret in Namespace holding user's password under "password"
+}
+
+type SecretSettings struct {
+	ServerSelector string `json:"serverSelector"` // label selector of secrets used for gpu discovery
+	NodePassword   string `json:"nodePassword"`   // name format of nodes' root password secret, %s is node name
+}
+
+type ResyncSettings struct {
+	Pods      Duration `json:"pods"`
+	Nodes     Duration `json:"nodes"`
+	Reconcile Duration `json:"reconcile"`
+}
+
+// SSHSettings are used for gpu discovery on servers, their host keys must be in KnownHosts
+type SSHSettings struct {
+	User           string   `json:"user"`
+	PrivateKey     string   `json:"privateKey"` // nodes' root password secret is tried when it's empty or refused
+	KnownHosts     string   `json:"knownHosts"`
+	Timeout        Duration `json:"timeout"`        // of connecting
+	CommandTimeout Duration `json:"commandTimeout"` // of each command
+}
+
+// LeaderElectionSettings let several replicas run, only the one holding the lease places and releases pods
+type LeaderElectionSettings struct {
+	Enabled       bool     `json:"enabled"`
+	LeaseName     string   `json:"leaseName"` // lease in Namespace
+	LeaseDuration Duration `json:"leaseDuration"`
+	RenewDeadline Duration `json:"renewDeadline"`
+	RetryPeriod   Duration `json:"retryPeriod"`
+}
+
+// PriorityClass is what requests choose their priority from, only classes allowing it may preempt
+type PriorityClass struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"` // higher is placed first
+	Preempt  bool   `json:"preempt"`  // requests of the class may evict pods of lower priority
+}
+
+// Settings are loaded once at startup, from defaults, then config file, env vars and flags, the later winning
+type Settings struct {
+	Namespace         string   `json:"namespace"` // where the manager's own secrets are, not its pods
+	ManagedNamespaces []string `json:"managedNamespaces"`
+	Port              int      `json:"port"`
+	Kubeconfig        string   `json:"kubeconfig"` // in-cluster config is used when it doesn't exist
+	Store             string   `json:"store"`      // mysql or memory
+	PlacementPolicy   string   `json:"placementPolicy"`
+	TenantConfig      string   `json:"tenantConfig"` // yaml or json file listing more tenants, e.g. from a ConfigMap of its own
+	RegistrySecret    string   `json:"registrySecret"`
+	ShutdownTimeout   Duration `json:"shutdownTimeout"` // how long in-flight requests may take on SIGTERM
+	GPUMemUnit        string   `json:"gpuMemUnit"`      // GiB or MiB, as gpushare device plugin's --memory-unit
+
+	PriorityClasses      []PriorityClass `json:"priorityClasses"`
+	DefaultPriorityClass string          `json:"defaultPriorityClass"` // of requests which don't name one
+
+	// Once any tenant is listed, requests of tenants which aren't are rejected, default tenant included
+	Tenants []TenantQuota `json:"tenants"`
+
+	DB             DBSettings             `json:"db"`
+	Secrets        SecretSettings         `json:"secrets"`
+	Resync         ResyncSettings         `json:"resync"`
+	LeaderElection LeaderElectionSettings `json:"leaderElection"`
+	SSH            SSHSettings            `json:"ssh"`
+}
+
+var current = DefaultSettings()
+
+func DefaultSettings() Settings {
+	home, _ := os.UserHomeDir()
+
+	return Settings{
+		Namespace:         "xrcloud",
+		ManagedNamespaces: []string{"xrcloud"},
+		Port:              31000,
+		Kubeconfig:        filepath.Join(home, ".kube", "config"),
+		Store:             "mysql",
+		RegistrySecret:    "regcred",
+		ShutdownTimeout:   Duration(30 * time.Second),
+		GPUMemUnit:        "GiB",
+		// Nothing is preempted until classes allowing it are configured
+		PriorityClasses:      []PriorityClass{{Name: "default"}},
+		DefaultPriorityClass: "default",
+		DB: DBSettings{
+			Host:           "10.0.1.110:30306",
+			Name:           "resourceBoard",
+			User:           "root",
+			PasswordSecret: "mysql-root",
+		},
+		Secrets: SecretSettings{
+			ServerSelector: "info=server",
+			NodePassword:   "%s-root-password",
+		},
+		Resync: ResyncSettings{
+			Pods:      Duration(30 * time.Second),
+			Nodes:     Duration(30 * time.Second),
+			Reconcile: Duration(5 * time.Minute),
+		},
+		// A single replica needs no lease, deployments running several enable it explicitly
+		LeaderElection: LeaderElectionSettings{
+			Enabled:       false,
+			LeaseName:     "resource-manager",
+			LeaseDuration: Duration(15 * time.Second),
+			RenewDeadline: Duration(10 * time.Second),
+			RetryPeriod:   Duration(2 * time.Second),
+		},
+		SSH: SSHSettings{
+			User:           "root",
+			PrivateKey:     filepath.Join(home, ".ssh", "id_rsa"),
+			KnownHosts:     filepath.Join(home, ".ssh", "known_hosts"),
+			Timeout:        Duration(10 * time.Second),
+			CommandTimeout: Duration(30 * time.Second),
+		},
+	}
+}
+
+// Get returns settings loaded at startup, or the defaults before that
+func Get() Settings {
+	return current
+}
+
+type option struct {
+	flag  string
+	env   string
+	usage string
+	set   func(s *Settings, value string) error
+}
+
+func stringOption(flag string, env string, usage string, field func(s *Settings) *string) option {
+	return option{flag, env, usage, func(s *Settings, value string) error {
+		*field(s) = value
+		return nil
+	}}
+}
+
+func durationOption(flag string, env string, usage string, field func(s *Settings) *Duration) option {
+	return option{flag, env, usage, func(s *Settings, value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(s) = Duration(parsed)
+		return nil
+	}}
+}
+
+var options = []option{
+	stringOption("namespace", "NAMESPACE", "namespace of the manager's secrets", func(s *Settings) *string { return &s.Namespace }),
+	{"managed-namespaces", "MANAGED_NAMESPACES", "comma separated namespaces pods may be created in, the first is the default", func(s *Settings, value string) error {
+		s.ManagedNamespaces = strings.Split(value, ",")
+		return nil
+	}},
+	{"port", "PORT", "http port", func(s *Settings, value string) error {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		s.Port = port
+		return nil
+	}},
+	stringOption("kubeconfig", "KUBECONFIG", "path of kubeconfig, in-cluster config is used when it doesn't exist", func(s *Settings) *string { return &s.Kubeconfig }),
+	stringOption("store", "RESOURCE_STORE", "resource store, mysql or memory", func(s *Settings) *string { return &s.Store }),
+	stringOption("placement-policy", "PLACEMENT_POLICY", "placement policy applied when a request doesn't choose one", func(s *Settings) *string { return &s.PlacementPolicy }),
+	stringOption("tenant-config", "TENANT_CONFIG", "yaml or json file listing tenants' quotas, added to config file's tenants", func(s *Settings) *string { return &s.TenantConfig }),
+	stringOption("registry-secret", "REGISTRY_SECRET", "image pull secret of created pods", func(s *Settings) *string { return &s.RegistrySecret }),
+	durationOption("shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long in-flight requests may take on SIGTERM", func(s *Settings) *Duration { return &s.ShutdownTimeout }),
+	stringOption("default-priority-class", "DEFAULT_PRIORITY_CLASS", "priority class of requests which don't name one", func(s *Settings) *string { return &s.DefaultPriorityClass }),
+	stringOption("gpu-mem-unit", "GPU_MEM_UNIT", "unit of aliyun.com/gpu-mem, GiB or MiB as gpushare device plugin", func(s *Settings) *string { return &s.GPUMemUnit }),
+	stringOption("db-host", "DB_HOST", "mysql host:port", func(s *Settings) *string { return &s.DB.Host }),
+	stringOption("db-name", "DB_NAME", "mysql database", func(s *Settings) *string { return &s.DB.Name }),
+	stringOption("db-user", "DB_USER", "mysql user", func(s *Settings) *string { return &s.DB.User }),
+	stringOption("db-password-secret", "DB_PASSWORD_SECRET", "secret holding mysql user's password", func(s *Settings) *string { return &s.DB.PasswordSecret }),
+	stringOption("server-secret-selector", "SERVER_SECRET_SELECTOR", "label selector of gpu discovery secrets", func(s *Settings) *string { return &s.Secrets.ServerSelector }),
+	stringOption("node-password-secret", "NODE_PASSWORD_SECRET", "name format of nodes' root password secret", func(s *Settings) *string { return &s.Secrets.NodePassword }),
+	durationOption("pod-resync", "POD_RESYNC", "resync period of pod informer", func(s *Settings) *Duration { return &s.Resync.Pods }),
+	durationOption("node-resync", "NODE_RESYNC", "resync period of node informer", func(s *Settings) *Duration { return &s.Resync.Nodes }),
+	durationOption("reconcile-period", "RECONCILE_PERIOD", "period of reconciling usage against live pods", func(s *Settings) *Duration { return &s.Resync.Reconcile }),
+	stringOption("ssh-user", "SSH_USER", "user of gpu servers", func(s *Settings) *string { return &s.SSH.User }),
+	stringOption("ssh-private-key", "SSH_PRIVATE_KEY", "private key of gpu servers' user", func(s *Settings) *string { return &s.SSH.PrivateKey }),
+	stringOption("ssh-known-hosts", "SSH_KNOWN_HOSTS", "known_hosts file holding gpu servers' host keys", func(s *Settings) *string { return &s.SSH.KnownHosts }),
+	durationOption("ssh-timeout", "SSH_TIMEOUT", "timeout of connecting to gpu servers", func(s *Settings) *Duration { return &s.SSH.Timeout }),
+	durationOption("ssh-command-timeout", "SSH_COMMAND_TIMEOUT", "timeout of each command on gpu servers", func(s *Settings) *Duration { return &s.SSH.CommandTimeout }),
+	{"leader-elect", "LEADER_ELECT", "elect a leader among replicas through a lease, required when running more than one", func(s *Settings, value string) error {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.LeaderElection.Enabled = enabled
+		return nil
+	}},
+	stringOption("lease-name", "LEASE_NAME", "name of leader election lease", func(s *Settings) *string { return &s.LeaderElection.LeaseName }),
+}
+
+// rawValue keeps a flag's string as given, it's applied once config file and env vars are
+type rawValue struct {
+	value *string
+}
+
+func (v rawValue) String() string {
+	if v.value == nil {
+		return ""
+	}
+	return *v.value
+}
+
+func (v rawValue) Set(value string) error {
+	*v.value = value
+	return nil
+}
+
+// Load builds settings from defaults, the yaml file of -config or CONFIG_FILE, env vars and flags in args.
+// It returns the arguments left after flags
+func Load(args []string) (Settings, []string, error) {
+	fs := flag.NewFlagSet("resourceManager", flag.ContinueOnError)
+
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "yaml config file")
+
+	flags := make(map[string]*string)
+	for _, opt := range options {
+		value := new(string)
+		fs.Var(rawValue{value}, opt.flag, fmt.Sprintf("%s (env %s)", opt.usage, opt.env))
+		flags[opt.flag] = value
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Settings{}, nil, err
+	}
+
+	settings := DefaultSettings()
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return Settings{}, nil, fmt.Errorf("[ERROR] Failed to read config file: %w", err)
+		}
+
+		// Unknown keys are rejected, a typo shouldn't silently fall back to the default
+		if err = yaml.UnmarshalStrict(data, &settings); err != nil {
+			return Settings{}, nil, fmt.Errorf("[ERROR] Failed to parse config file %s: %w", *configFile, err)
+		}
+	}
+
+	for _, opt := range options {
+		if value, ok := os.LookupEnv(opt.env); ok && value != "" {
+			if err := opt.set(&settings, value); err != nil {
+				return Settings{}, nil, fmt.Errorf("[ERROR] Invalid env %s: %w", opt.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if value, ok := flags[f.Name]; ok && err == nil {
+			if setErr := lookupOption(f.Name).set(&settings, *value); setErr != nil {
+				err = fmt.Errorf("[ERROR] Invalid flag -%s: %w", f.Name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return Settings{}, nil, err
+	}
+
+	if settings.TenantConfig != "" {
+		tenants, err := loadTenants(settings.TenantConfig)
+		if err != nil {
+			return Settings{}, nil, err
+		}
+		settings.Tenants = append(settings.Tenants, tenants...)
+	}
+
+	if err = settings.Validate(); err != nil {
+		return Settings{}, nil, err
+	}
+
+	current = settings
+	SetManagedNamespaces(settings.ManagedNamespaces)
+
+	return settings, fs.Args(), nil
+}
+
+// loadTenants reads a list of tenants' quotas, yaml or json
+func loadTenants(path string) ([]TenantQuota, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to read tenant config: %w", err)
+	}
+
+	var tenants []TenantQuota
+	if err = yaml.UnmarshalStrict(data, &tenants); err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to parse tenant config %s: %w", path, err)
+	}
+
+	return tenants, nil
+}
+
+func lookupOption(name string) option {
+	for _, opt := range options {
+		if opt.flag == name {
+			return opt
+		}
+	}
+	return option{}
+}
+
+func (s Settings) Validate() error {
+	var errs []error
+
+	if s.Namespace == "" {
+		errs = append(errs, errors.New("namespace is required"))
+	}
+
+	managed := 0
+	for _, namespace := range s.ManagedNamespaces {
+		if strings.TrimSpace(namespace) != "" {
+			managed++
+		}
+	}
+	if managed == 0 {
+		errs = append(errs, errors.New("at least one managed namespace is required"))
+	}
+
+	if s.Port <= 0 || s.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d is out of range", s.Port))
+	}
+
+	if s.Store != "mysql" && s.Store != "memory" {
+		errs = append(errs, fmt.Errorf("store %q must be mysql or memory", s.Store))
+	}
+
+	if s.Store == "mysql" && (s.DB.Host == "" || s.DB.Name == "" || s.DB.User == "" || s.DB.PasswordSecret == "") {
+		errs = append(errs, errors.New("db host, name, user and passwordSecret are required by mysql store"))
+	}
+
+	if !strings.Contains(s.Secrets.NodePassword, "%s") {
+		errs = append(errs, errors.New("secrets.nodePassword must contain %s for node name"))
+	}
+
+	if s.Resync.Pods < 0 || s.Resync.Nodes < 0 {
+		errs = append(errs, errors.New("informer resync periods must not be negative"))
+	}
+
+	if s.GPUMemUnit != "GiB" && s.GPUMemUnit != "MiB" {
+		errs = append(errs, fmt.Errorf("gpuMemUnit %q must be GiB or MiB", s.GPUMemUnit))
+	}
+
+	classes := make(map[string]bool)
+	for _, class := range s.PriorityClasses {
+		if class.Name == "" {
+			errs = append(errs, errors.New("priority class without name"))
+		} else if classes[class.Name] {
+			errs = append(errs, fmt.Errorf("priority class %q is defined twice", class.Name))
+		}
+		classes[class.Name] = true
+	}
+	if !classes[s.DefaultPriorityClass] {
+		errs = append(errs, fmt.Errorf("defaultPriorityClass %q is not one of priorityClasses", s.DefaultPriorityClass))
+	}
+
+	tenants := make(map[string]bool)
+	for _, tenant := range s.Tenants {
+		if tenant.Name == "" {
+			errs = append(errs, errors.New("tenant without name"))
+		} else if tenants[tenant.Name] {
+			errs = append(errs, fmt.Errorf("tenant %q is defined twice", tenant.Name))
+		}
+		if tenant.MaxVRAM < 0 || tenant.MaxPods < 0 || tenant.MaxVRAMPerPod < 0 {
+			errs = append(errs, fmt.Errorf("tenant %q has negative quota", tenant.Name))
+		}
+		tenants[tenant.Name] = true
+	}
+
+	if s.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown timeout must be greater than 0"))
+	}
+
+	if s.Resync.Reconcile <= 0 {
+		errs = append(errs, errors.New("reconcile period must be greater than 0"))
+	}
+
+	if s.SSH.User == "" || s.SSH.KnownHosts == "" {
+		errs = append(errs, errors.New("ssh user and knownHosts are required"))
+	}
+
+	if s.SSH.Timeout <= 0 || s.SSH.CommandTimeout <= 0 {
+		errs = append(errs, errors.New("ssh timeouts must be greater than 0"))
+	}
+
+	if election := s.LeaderElection; election.Enabled {
+		if election.LeaseName == "" {
+			errs = append(errs, errors.New("leaderElection.leaseName is required"))
+		}
+		if election.RetryPeriod <= 0 || election.RenewDeadline <= election.RetryPeriod || election.LeaseDuration <= election.RenewDeadline {
+			errs = append(errs, errors.New("leaderElection needs leaseDuration > renewDeadline > retryPeriod > 0"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("[ERROR] Invalid settings: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// LookupPriorityClass returns the named priority class, or the default one when name is empty
+func (s Settings) LookupPriorityClass(name string) (PriorityClass, bool) {
+	if name == "" {
+		name = s.DefaultPriorityClass
+	}
+
+	for _, class := range s.PriorityClasses {
+		if class.Name == name {
+			return class, true
+		}
+	}
+
+	return PriorityClass{Name: name}, false
+}
@@ -0,0 +1,225 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	// Registered first, so it runs once env vars are restored
+	t.Cleanup(func() { Load(nil) })
+
+	config := writeFile(t, "config.yaml", `
+port: 32000
+store: memory
+placementPolicy: worst-fit
+shutdownTimeout: 45s
+`)
+
+	// Env overrides file, flag overrides env
+	t.Setenv("PLACEMENT_POLICY", "first-fit")
+	t.Setenv("SHUTDOWN_TIMEOUT", "50s")
+
+	settings, args, err := Load([]string{"-config", config, "-shutdown-timeout", "55s", "migrate", "up"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if settings.Namespace != "xrcloud" {
+		t.Errorf("namespace = %q, want default xrcloud", settings.Namespace)
+	}
+	if settings.Port != 32000 || settings.Store != "memory" {
+		t.Errorf("port %d, store %q, want 32000 and memory from file", settings.Port, settings.Store)
+	}
+	if settings.PlacementPolicy != "first-fit" {
+		t.Errorf("placementPolicy = %q, want first-fit from env", settings.PlacementPolicy)
+	}
+	if time.Duration(settings.ShutdownTimeout) != 55*time.Second {
+		t.Errorf("shutdownTimeout = %v, want 55s from flag", time.Duration(settings.ShutdownTimeout))
+	}
+	if strings.Join(args, " ") != "migrate up" {
+		t.Errorf("args = %v, want [migrate up]", args)
+	}
+	if Get().Port != 32000 {
+		t.Errorf("Get() isn't the loaded settings")
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	t.Cleanup(func() { Load(nil) })
+
+	tests := []struct {
+		name    string
+		config  string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{name: "unknown key", config: "prot: 32000\n", wantErr: "unknown field"},
+		{name: "invalid env", env: map[string]string{"PORT": "http"}, wantErr: "Invalid env PORT"},
+		{name: "invalid flag", args: []string{"-shutdown-timeout", "soon"}, wantErr: "Invalid flag -shutdown-timeout"},
+		{name: "invalid settings", args: []string{"-store", "redis"}, wantErr: `store "redis" must be mysql or memory`},
+		{name: "missing tenant config", args: []string{"-tenant-config", "/nonexistent/tenants.yaml"}, wantErr: "Failed to read tenant config"},
+	}
+
+	for _, test := range tests {
+		for key, value := range test.env {
+			t.Setenv(key, value)
+		}
+
+		args := test.args
+		if test.config != "" {
+			args = append([]string{"-config", writeFile(t, "config.yaml", test.config)}, args...)
+		}
+
+		_, _, err := Load(args)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: Load error = %v, want %q", test.name, err, test.wantErr)
+		}
+
+		for key := range test.env {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	t.Cleanup(func() { Load(nil) })
+
+	config := writeFile(t, "config.yaml", `
+tenants:
+  - name: team
+    maxVram: 16
+    maxPods: 4
+`)
+
+	for _, tenantConfig := range []string{
+		writeFile(t, "tenants.yaml", "- name: research\n  maxVram: 1536Mi\n  maxVramPerPod: 1\n"),
+		writeFile(t, "tenants.json", `[{"name": "research", "maxVram": "1536Mi", "maxVramPerPod": 1}]`),
+	} {
+		settings, _, err := Load([]string{"-config", config, "-tenant-config", tenantConfig})
+		if err != nil {
+			t.Fatalf("Load(%s): %v", filepath.Base(tenantConfig), err)
+		}
+
+		want := []TenantQuota{
+			{Name: "team", MaxVRAM: VRAM(16384), MaxPods: 4},
+			{Name: "research", MaxVRAM: VRAM(1536), MaxVRAMPerPod: VRAM(1024)},
+		}
+		if len(settings.Tenants) != len(want) {
+			t.Fatalf("%s: tenants = %+v, want %+v", filepath.Base(tenantConfig), settings.Tenants, want)
+		}
+		for i := range want {
+			if settings.Tenants[i] != want[i] {
+				t.Errorf("%s: tenant %d = %+v, want %+v", filepath.Base(tenantConfig), i, settings.Tenants[i], want[i])
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(s *Settings)
+		wantErr string
+	}{
+		{name: "defaults", change: func(s *Settings) {}},
+		{name: "no namespace", change: func(s *Settings) { s.Namespace = "" }, wantErr: "namespace is required"},
+		{name: "blank managed namespaces", change: func(s *Settings) { s.ManagedNamespaces = []string{" ", ""} }, wantErr: "at least one managed namespace is required"},
+		{name: "port", change: func(s *Settings) { s.Port = 70000 }, wantErr: "port 70000 is out of range"},
+		{name: "mysql without db", change: func(s *Settings) { s.DB.Host = "" }, wantErr: "db host, name, user and passwordSecret are required"},
+		{name: "memory without db", change: func(s *Settings) { s.Store = "memory"; s.DB = DBSettings{} }},
+		{name: "node password format", change: func(s *Settings) { s.Secrets.NodePassword = "root-password" }, wantErr: "must contain %s"},
+		{name: "gpu mem unit", change: func(s *Settings) { s.GPUMemUnit = "GB" }, wantErr: `gpuMemUnit "GB" must be GiB or MiB`},
+		{name: "shutdown timeout", change: func(s *Settings) { s.ShutdownTimeout = 0 }, wantErr: "shutdown timeout must be greater than 0"},
+		{name: "reconcile period", change: func(s *Settings) { s.Resync.Reconcile = 0 }, wantErr: "reconcile period must be greater than 0"},
+		{name: "ssh timeouts", change: func(s *Settings) { s.SSH.CommandTimeout = 0 }, wantErr: "ssh timeouts must be greater than 0"},
+		{name: "lease durations", change: func(s *Settings) {
+			s.LeaderElection.Enabled = true
+			s.LeaderElection.RenewDeadline = s.LeaderElection.LeaseDuration
+		}, wantErr: "leaseDuration > renewDeadline > retryPeriod > 0"},
+		{name: "tenant twice", change: func(s *Settings) { s.Tenants = []TenantQuota{{Name: "team"}, {Name: "team"}} }, wantErr: `tenant "team" is defined twice`},
+		{name: "tenant without name", change: func(s *Settings) { s.Tenants = []TenantQuota{{MaxPods: 1}} }, wantErr: "tenant without name"},
+		{name: "negative quota", change: func(s *Settings) { s.Tenants = []TenantQuota{{Name: "team", MaxPods: -1}} }, wantErr: `tenant "team" has negative quota`},
+		{name: "every error at once", change: func(s *Settings) { s.Port = 0; s.Store = "redis" }, wantErr: `port 0 is out of range
+store "redis" must be mysql or memory`},
+	}
+
+	for _, test := range tests {
+		settings := DefaultSettings()
+		test.change(&settings)
+
+		err := settings.Validate()
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: Validate: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: Validate error = %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidatePriorityClasses(t *testing.T) {
+	tests := []struct {
+		name    string
+		classes []PriorityClass
+		def     string
+		wantErr string
+	}{
+		{name: "defaults", classes: DefaultSettings().PriorityClasses, def: "default"},
+		{name: "preempting class", classes: []PriorityClass{{Name: "batch"}, {Name: "interactive", Priority: 100, Preempt: true}}, def: "batch"},
+		{name: "unknown default", classes: []PriorityClass{{Name: "batch"}}, def: "default", wantErr: `defaultPriorityClass "default" is not one of priorityClasses`},
+		{name: "no classes", def: "default", wantErr: `defaultPriorityClass "default" is not one of priorityClasses`},
+		{name: "twice", classes: []PriorityClass{{Name: "batch"}, {Name: "batch", Priority: 10}}, def: "batch", wantErr: `priority class "batch" is defined twice`},
+		{name: "without name", classes: []PriorityClass{{Name: "batch"}, {Priority: 10}}, def: "batch", wantErr: "priority class without name"},
+	}
+
+	for _, test := range tests {
+		settings := DefaultSettings()
+		settings.PriorityClasses = test.classes
+		settings.DefaultPriorityClass = test.def
+
+		err := settings.Validate()
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: Validate: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: Validate error = %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestLookupPriorityClass(t *testing.T) {
+	settings := DefaultSettings()
+	settings.PriorityClasses = []PriorityClass{{Name: "batch"}, {Name: "interactive", Priority: 100, Preempt: true}}
+	settings.DefaultPriorityClass = "batch"
+
+	if class, ok := settings.LookupPriorityClass(""); !ok || class.Name != "batch" {
+		t.Errorf(`LookupPriorityClass("") = %+v, %t, want batch`, class, ok)
+	}
+	if class, ok := settings.LookupPriorityClass("interactive"); !ok || class.Priority != 100 || !class.Preempt {
+		t.Errorf("LookupPriorityClass(interactive) = %+v, %t", class, ok)
+	}
+	if _, ok := settings.LookupPriorityClass("root"); ok {
+		t.Errorf("LookupPriorityClass(root) found a class which isn't configured")
+	}
+}
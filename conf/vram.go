@@ -0,0 +1,84 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const bytesPerMiB = 1024 * 1024
+
+// VRAM is an amount of gpu memory in MiB, the unit vram is accounted in.
+// In json it's a kubernetes quantity like "1536Mi" or "3Gi", bare numbers are GiB as requests were before
+type VRAM int
+
+func ParseVRAM(value string) (VRAM, error) {
+	value = strings.TrimSpace(value)
+
+	// Unit-less numbers, fractions included, are GiB rather than the bytes a quantity would take them for
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		value += "Gi"
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, fmt.Errorf("[ERROR] Invalid vram %q, expected a quantity like 1536Mi or 3Gi", value)
+	}
+
+	// Partial MiB are rounded up, so the pod never gets less than it asked for
+	bytes := quantity.Value()
+	return VRAM((bytes + bytesPerMiB - 1) / bytesPerMiB), nil
+}
+
+func (v VRAM) MiB() int {
+	return int(v)
+}
+
+func (v VRAM) String() string {
+	if v%1024 == 0 {
+		return fmt.Sprintf("%dGi", v/1024)
+	}
+	return fmt.Sprintf("%dMi", int(v))
+}
+
+func (v VRAM) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func (v *VRAM) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		var gib json.Number
+		if err = json.Unmarshal(data, &gib); err != nil {
+			return fmt.Errorf("[ERROR] Invalid vram %s, expected a quantity like \"1536Mi\" or a number of GiB", data)
+		}
+		value = gib.String()
+	}
+
+	parsed, err := ParseVRAM(value)
+	if err != nil {
+		return err
+	}
+
+	*v = parsed
+	return nil
+}
+
+// ToDevicePluginUnit converts MiB to the unit gpushare device plugin counts aliyun.com/gpu-mem in, rounding up
+func ToDevicePluginUnit(mib int) int {
+	if Get().GPUMemUnit == "MiB" {
+		return mib
+	}
+	return (mib + 1023) / 1024
+}
+
+// FromDevicePluginUnit converts aliyun.com/gpu-mem of a pod to MiB
+func FromDevicePluginUnit(value int) int {
+	if Get().GPUMemUnit == "MiB" {
+		return value
+	}
+	return value * 1024
+}
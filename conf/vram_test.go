@@ -0,0 +1,78 @@
+package conf
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseVRAM(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    VRAM
+		wantErr bool
+	}{
+		{value: "3", want: 3072},
+		{value: " 2 ", want: 2048},
+		{value: "1.5", want: 1536},
+		{value: "0.25", want: 256},
+		{value: "1536Mi", want: 1536},
+		{value: "3Gi", want: 3072},
+		{value: "1.5Gi", want: 1536},
+		{value: "1M", want: 1}, // 10^6 bytes, rounded up to a MiB
+		{value: "1e3", wantErr: true},
+		{value: "NaN", wantErr: true},
+		{value: "Inf", wantErr: true},
+		{value: "3GB", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseVRAM(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseVRAM(%q) = %v, want error", test.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseVRAM(%q) failed: %v", test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseVRAM(%q) = %d MiB, want %d MiB", test.value, got, test.want)
+		}
+	}
+}
+
+func TestVRAMUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    VRAM
+		wantErr bool
+	}{
+		{data: `4`, want: 4096},
+		{data: `1.5`, want: 1536},
+		{data: `"1.5"`, want: 1536},
+		{data: `"512Mi"`, want: 512},
+		{data: `true`, wantErr: true},
+		{data: `"lots"`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		var got VRAM
+		err := json.Unmarshal([]byte(test.data), &got)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("unmarshal %s = %v, want error", test.data, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unmarshal %s failed: %v", test.data, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("unmarshal %s = %d MiB, want %d MiB", test.data, got, test.want)
+		}
+	}
+}
@@ -2,36 +2,78 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"path/filepath"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
-	//"resourceManager/conf"
+	"resourceManager/components/apiServer"
 	"resourceManager/components/deployManager"
+	"resourceManager/conf"
 	"resourceManager/utils/nvidia"
 	//corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"resourceManager/components/informer"
+	"resourceManager/components/leaderElection"
+	"resourceManager/components/reconciler"
+	"resourceManager/components/tenantManager"
+	"resourceManager/utils/metrics"
 	"resourceManager/utils/mysql"
+	"resourceManager/utils/store"
 )
 
 var (
-	clientset   *kubernetes.Clientset
-	namespace   = "xrcloud"
-	secretNames []string
-	ids         []string
-	vram        []int
+	clientset     *kubernetes.Clientset
+	resourceStore store.ResourceStore
+	settings      conf.Settings
+	commandArgs   []string // e.g. migrate up, run instead of the server
+
+	// leading tracks lead, so shutdown waits for it, and no lead starts once shutdown began
+	leading      sync.WaitGroup
+	leadMutex    sync.Mutex
+	shuttingDown bool
 )
 
+// buildKubeConfig uses kubeconfig when it exists, otherwise the service account of the pod running the manager
+func buildKubeConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		if _, err := os.Stat(kubeconfig); err == nil {
+			return clientcmd.BuildConfigFromFlags("", kubeconfig)
+		}
+	}
+
+	config, err := rest.InClusterConfig()
+	if errors.Is(err, rest.ErrNotInCluster) {
+		return nil, fmt.Errorf("[ERROR] No kubeconfig at %q and not running in a cluster", kubeconfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("[INFO] Running in cluster, using service account")
+
+	return config, nil
+}
+
 func init() {
-	kubeconfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
+	var err error
 
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	settings, commandArgs, err = conf.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Fail: %v", err)
+	}
+
+	config, err := buildKubeConfig(settings.Kubeconfig)
 	if err != nil {
 		log.Fatalf("Failed to build config: %v", err)
 	}
@@ -43,14 +85,44 @@ func init() {
 
 	log.Println("[INFO] Create k8s client, successfully")
 
+	log.Printf("[INFO] Managing pods in namespaces %v", conf.ManagedNamespaces())
+
+	// Dev mode keeps gpu resources in memory, without database
+	if settings.Store == "memory" {
+		resourceStore = store.NewMemoryStore()
+		log.Println("[INFO] Using in-memory resource store")
+	} else {
+		resourceStore, err = mysql.NewStore(clientset)
+		if err != nil {
+			log.Fatalf("Fail: %v", err)
+		}
+	}
+
+	// migrate subcommand applies migrations itself, so it can also revert them
+	if len(commandArgs) > 0 && commandArgs[0] == "migrate" {
+		return
+	}
+
+	err = resourceStore.Init()
+	if err != nil {
+		log.Fatalf("Fail: %v", err)
+	}
+
+	log.Println("[INFO] Initialize Database, successfully")
+}
+
+// initResources discovers gpus of every server and corrects usage against live pods, it's run by the leader only
+func initResources() {
 	// Get secret name defined root password
-	secrets, err := clientset.CoreV1().Secrets(namespace).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: "info=server",
+	secrets, err := clientset.CoreV1().Secrets(settings.Namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: settings.Secrets.ServerSelector,
 	})
 	if err != nil {
 		log.Fatalf("Fail: %v", err)
 	}
 
+	// Leadership may be acquired many times, nothing is kept from the previous run
+	var secretNames []string
 	for _, secret := range secrets.Items {
 		secretNames = append(secretNames, secret.Name)
 	}
@@ -58,49 +130,203 @@ func init() {
 	// Extracting GPU resources from each server through secret
 	// Then, Initialize database with GPU resources
 	for _, secretName := range secretNames {
-		servers, err := nvidia.GetServerInfo(clientset, namespace, secretName)
+		servers, err := nvidia.GetServerInfo(clientset, settings.Namespace, secretName)
 		if err != nil {
 			log.Fatalf("Fail: %v", err)
 		}
 
 		for _, server := range servers {
-			ids, vram, err = nvidia.GetGPUMemoryPerIndex(server.IPAddr, server.Password)
+			devices, err := nvidia.DiscoverGPUs(server.IPAddr, server.Password)
 			if err != nil {
 				log.Fatalf("Fail: %v", err)
 			}
-			err = mysql.InitDB(clientset, server.NodeName, ids, vram)
+			err = resourceStore.InsertResource(server.NodeName, devices)
 			if err != nil {
 				log.Fatalf("Fail: %v", err)
 			}
 		}
 	}
 
-	log.Println("[INFO] Initialize Database, successfully")
+	// Usage counts from before a restart are corrected against live pods
+	err = reconciler.Reconcile(clientset, resourceStore, nil)
+	if err != nil {
+		log.Fatalf("Fail: %v", err)
+	}
+
+	log.Println("[INFO] Initialize gpu resources, successfully")
+}
+
+// lead runs everything which changes allocations, on a single replica at a time.
+// It returns once ctx is done and the queue, reconciler and informers have stopped
+func lead(ctx context.Context) {
+	leadMutex.Lock()
+	if shuttingDown {
+		leadMutex.Unlock()
+		return
+	}
+	leading.Add(1)
+	leadMutex.Unlock()
+	defer leading.Done()
+
+	initResources()
+
+	stopCh := ctx.Done()
+	var workers sync.WaitGroup
+
+	run := func(worker func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker()
+		}()
+	}
+
+	podInformers := informer.CreatePodInformers(clientset, resourceStore, deployManager.NotifyRelease)
+
+	run(func() { deployManager.RunQueue(clientset, resourceStore, stopCh) })
+	run(func() {
+		reconciler.RunReconciler(clientset, resourceStore, time.Duration(settings.Resync.Reconcile), deployManager.NotifyRelease, stopCh)
+	})
+
+	nodeInformer := informer.CreateNodeInformer(clientset, resourceStore)
+
+	synced := []cache.InformerSynced{nodeInformer.HasSynced}
+	for _, podInformer := range podInformers {
+		run(func() { podInformer.Run(stopCh) })
+		synced = append(synced, podInformer.HasSynced)
+	}
+	run(func() { nodeInformer.Run(stopCh) })
+
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		if ctx.Err() == nil {
+			log.Fatalf("[ERROR] Failed to sync informer cache")
+		}
+	} else {
+		leaderElection.SetReady()
+		log.Println("[INFO] Started monitoring for pods and nodes...")
+	}
+
+	<-stopCh
+
+	// Queue finishes the placement it's in the middle of before returning
+	workers.Wait()
+
+	deployManager.DrainGroups(resourceStore)
+
+	log.Println("[INFO] Stopped queue, reconciler and informers")
+}
+
+// shutdown stops accepting requests and lets in-flight ones finish, then stops leading and closes the store.
+// In-flight preemptions are cancelled rather than waited for, victims may take longer than ShutdownTimeout to go
+func shutdown(server *http.Server, stopServing context.CancelFunc, stopLeading context.CancelFunc, stopElection context.CancelFunc, electionDone <-chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(settings.ShutdownTimeout))
+	defer cancel()
+
+	stopServing()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[ERROR] Failed to finish in-flight requests: %v", err)
+	}
+
+	leadMutex.Lock()
+	shuttingDown = true
+	leadMutex.Unlock()
+
+	stopLeading()
+	leading.Wait()
+
+	// Lease is given back only when nothing is placed or released here anymore
+	stopElection()
+	<-electionDone
+
+	if err := resourceStore.Close(); err != nil {
+		log.Printf("[ERROR] Failed to close resource store: %v", err)
+	}
+
+	log.Println("[INFO] Shut down, successfully")
 }
 
 func main() {
-	http.HandleFunc("/create", deployManager.DeployPodHandler(clientset))
+	if len(commandArgs) > 0 {
+		if err := runCommand(commandArgs); err != nil {
+			log.Fatalf("Fail: %v", err)
+		}
+		return
+	}
+
+	// Placement policy applied when a request doesn't choose one
+	if settings.PlacementPolicy != "" {
+		if err := deployManager.SetDefaultPolicy(settings.PlacementPolicy); err != nil {
+			log.Fatalf("Fail: %v", err)
+		}
+	}
+
+	// Once tenants are configured, tenants without a quota, default included, are rejected
+	if err := tenantManager.SetQuotas(settings.Tenants); err != nil {
+		log.Fatalf("Fail: %v", err)
+	}
+
+	// Queue and groups are kept by the leader, so their endpoints are forwarded to it as well as writes
+	leaderOnly := func(handler http.HandlerFunc) http.HandlerFunc {
+		return leaderElection.LeaderOnly(clientset, handler)
+	}
+
+	http.HandleFunc("/create", leaderOnly(deployManager.DeployPodHandler(clientset, resourceStore)))
+	http.HandleFunc("GET /jobs/{id}", leaderOnly(deployManager.GetJobHandler()))
+	http.HandleFunc("DELETE /jobs/{id}", leaderOnly(deployManager.CancelJobHandler()))
+	http.HandleFunc("POST /groups", leaderOnly(deployManager.DeployGroupHandler(clientset, resourceStore)))
+	http.HandleFunc("GET /groups/{id}", leaderOnly(deployManager.GetGroupHandler()))
+	http.HandleFunc("DELETE /groups/{id}", leaderOnly(deployManager.CancelGroupHandler(resourceStore)))
+	http.HandleFunc("GET /metrics", metrics.Handler())
+	http.HandleFunc("GET /resources", apiServer.ListResourcesHandler(resourceStore))
+	http.HandleFunc("GET /resources/{node}", apiServer.ListResourcesHandler(resourceStore))
+	http.HandleFunc("GET /resources/{node}/{gpu}", apiServer.ListResourcesHandler(resourceStore))
+	http.HandleFunc("GET /pods", apiServer.ListPodsHandler(clientset))
+	http.HandleFunc("GET /pods/{name}", apiServer.GetPodHandler(clientset))
+	http.HandleFunc("DELETE /pods/{name}", leaderOnly(apiServer.DeletePodHandler(clientset, resourceStore, deployManager.NotifyRelease)))
+	// Tenants' usage counts pending queue and group members, which only the leader has
+	http.HandleFunc("GET /tenants", leaderOnly(tenantManager.ListUsageHandler(resourceStore)))
+	http.HandleFunc("GET /tenants/{name}", leaderOnly(tenantManager.GetUsageHandler(resourceStore)))
+	http.HandleFunc("GET /usage", apiServer.UsageHandler(resourceStore))
+
+	// Requests' contexts are cancelled on shutdown, so preemptions in flight stop waiting for their victims
+	serveCtx, stopServing := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        fmt.Sprintf(":%d", settings.Port),
+		BaseContext: func(net.Listener) context.Context { return serveCtx },
+	}
 	go func() {
-		port := 31000
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("Error starting server: %s", err.Error())
 		}
 	}()
 
-	podInformer := informer.CreatePodInformer(clientset)
-	stopCh := make(chan struct{})
-	defer close(stopCh)
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	go podInformer.Run(stopCh)
+	leadCtx, stopLeading := context.WithCancel(context.Background())
+	electionCtx, stopElection := context.WithCancel(context.Background())
 
-	if !cache.WaitForCacheSync(stopCh, podInformer.HasSynced) {
-		log.Fatalf("[ERROR] Failed to sync informer cache")
+	electionDone := make(chan struct{})
+
+	// Followers serve read-only endpoints, the leader runs informers and allocations
+	if settings.LeaderElection.Enabled {
+		go func() {
+			defer close(electionDone)
+
+			err := leaderElection.Run(electionCtx, clientset, settings, func(context.Context) { lead(leadCtx) })
+			if err != nil {
+				log.Fatalf("Fail: %v", err)
+			}
+		}()
+	} else {
+		close(electionDone)
+		go lead(leadCtx)
 	}
 
-	log.Println("[INFO] Started monitoring for pods...")
+	<-signalCtx.Done()
+	log.Println("[INFO] Shutting down...")
 
-	//informer.StartMonitoringNode(clientset)
-	select {}
+	shutdown(server, stopServing, stopLeading, stopElection, electionDone)
 	/*
 
 			err = mysql.AllocateVRAMResource(clientset, "ketiops-gpu-node-1", "0", 2)
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"resourceManager/utils/mysql"
+)
+
+const migrateUsage = "usage: resourceManager [flags] migrate up|down [n]|status"
+
+// runCommand runs a subcommand instead of the server
+func runCommand(args []string) error {
+	if args[0] != "migrate" {
+		return fmt.Errorf("[ERROR] Unknown command %q, %s", args[0], migrateUsage)
+	}
+
+	defer resourceStore.Close()
+
+	return runMigrate(args[1:])
+}
+
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New("[ERROR] " + migrateUsage)
+	}
+
+	db, ok := resourceStore.(*mysql.Store)
+	if !ok {
+		return errors.New("[ERROR] Migrations only apply to mysql store")
+	}
+
+	switch args[0] {
+	case "up":
+		return db.MigrateUp()
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("[ERROR] Invalid number of migrations %q", args[1])
+			}
+			steps = n
+		}
+		return db.MigrateDown(steps)
+
+	case "status":
+		statuses, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return w.Flush()
+
+	default:
+		return fmt.Errorf("[ERROR] Unknown migrate command %q, %s", args[0], migrateUsage)
+	}
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Minimal registry exposed in prometheus text format,
+// series are keyed by name and labels, e.g. `gpu_vram{node="a",gpu="0"}`
+var (
+	values = make(map[string]float64)
+	mu     sync.Mutex
+)
+
+func Series(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func Add(series string, value float64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	values[series] += value
+}
+
+func Set(series string, value float64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	values[series] = value
+}
+
+func Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		var lines []string
+		for series, value := range values {
+			lines = append(lines, fmt.Sprintf("%s %g", series, value))
+		}
+		mu.Unlock()
+
+		sort.Strings(lines)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	}
+}
@@ -1,49 +1,37 @@
 package mysql
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
-	"k8s.io/client-go/kubernetes"
+	"resourceManager/conf"
+	"resourceManager/utils/store"
 )
 
-func GetAvailableResource(clientset *kubernetes.Clientset) ([]map[string]interface{}, error) {
-	// Extract available resources
-	// Firstly, Get DB Connector
-	db, err := GetDBConnector(clientset)
-	if err != nil {
-		return nil, fmt.Errorf("[ERROR] Failed to get db connector for getting gpu resource: %w", err)
-	}
-
-	// Secondly, get gpu resource from db
-	selectSQL := fmt.Sprintf(`SELECT node_name, gpu_index, total_vram, vram_usage, vram_remain, is_available FROM gpuResource`)
+func (s *Store) ListResources() ([]conf.GPUResource, error) {
+	// Get gpu resource from db
+	selectSQL := `SELECT node_name, gpu_index, total_vram, vram_usage, vram_remain, is_available, is_schedulable,
+			uuid, model, bus_id, memory_mib FROM gpuResource`
 
-	rows, err := db.Query(selectSQL)
+	rows, err := s.db.Query(selectSQL)
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] Failed to get rows from table: %w", err)
 	}
 	defer rows.Close()
 
-	// Lastly, Scan rows and extract values
-	var results []map[string]interface{}
+	// Scan rows and extract values
+	var results []conf.GPUResource
 
 	for rows.Next() {
-		var nodeName, gpuIndex string
-		var totalVram, vramUsage, vramRemain, available int
-		if err = rows.Scan(&nodeName, &gpuIndex, &totalVram, &vramUsage, &vramRemain, &available); err != nil {
+		var row conf.GPUResource
+		if err = rows.Scan(&row.NodeName, &row.GPUIndex, &row.TotalVRAM, &row.VRAMUsage, &row.VRAMRemain, &row.IsAvailable, &row.IsSchedulable,
+			&row.UUID, &row.Model, &row.BusID, &row.MemoryMiB); err != nil {
 			return nil, fmt.Errorf("[ERROR] Failed to scan gpu resource: %w", err)
 		}
 
-		row := map[string]interface{}{
-			"node_name":    nodeName,
-			"gpu_index":    gpuIndex,
-			"total_vram":   totalVram,
-			"vram_usage":   vramUsage,
-			"vram_remain":  vramRemain,
-			"is_available": available,
-		}
-
 		results = append(results, row)
 	}
 
@@ -52,127 +40,232 @@ func GetAvailableResource(clientset *kubernetes.Clientset) ([]map[string]interfa
 	return results, nil
 }
 
-func AllocateResource(clientset *kubernetes.Clientset, nodeName string, gpuIndex string, totalVram int, vramUsage int, vramRemain int, available int, vramReq int) error {
-	// Get DB Connector and Update DB
-	db, err := GetDBConnector(clientset)
+// Allocate reserves vramReq on every gpu and records them in ledger, in one transaction
+func (s *Store) Allocate(podName string, namespace string, tenant string, image string, nodeName string, gpuIndexes []string, vramReq int) ([]int64, error) {
+	var ids []int64
+
+	err := s.inTx(func(tx *sql.Tx) (err error) {
+		ids, err = allocate(tx, podName, namespace, tenant, image, nodeName, gpuIndexes, vramReq)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("[ERROR] Failed to get db connector for allocating resource: %w", err)
+		return nil, err
 	}
 
-	// Update DB
-	if vramUsage+vramReq == totalVram && vramRemain-vramReq == 0 {
-		updateSQL := "UPDATE gpuResource SET vram_usage = ?, vram_remain = ?, is_available = ? WHERE gpu_index = ? AND node_name = ?"
-		available = 0
+	log.Println("[INFO] Allocate Resource, successfully")
 
-		_, err = db.Exec(updateSQL, vramUsage+vramReq, vramRemain-vramReq, available, gpuIndex, nodeName)
-		if err != nil {
-			return fmt.Errorf("[ERROR] Failed to exec query(update gpuResource): %w", err)
+	return ids, nil
+}
+
+// Preempt releases victims' allocations and reserves their vram for the pod, in one transaction.
+// Nothing is released when the gpus still can't hold the pod afterwards
+func (s *Store) Preempt(victims []store.PodRef, podName string, namespace string, tenant string, image string, nodeName string, gpuIndexes []string, vramReq int) ([]int64, error) {
+	var ids []int64
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		// Victims' gpus are locked together with the pod's, before any of their allocations
+		gpus := gpuKeys(nodeName, gpuIndexes)
+		for _, victim := range victims {
+			allocations, err := selectAllocations(tx, releasePodSQL, victim.Namespace, victim.Name, "", "")
+			if err != nil {
+				return err
+			}
+			gpus = append(gpus, allocationGPUs(allocations)...)
 		}
-	} else {
-		updateSQL := "UPDATE gpuResource SET vram_usage = ?, vram_remain = ? WHERE gpu_index = ? AND node_name = ?"
-		_, err = db.Exec(updateSQL, vramUsage+vramReq, vramRemain-vramReq, gpuIndex, nodeName)
-		if err != nil {
-			return fmt.Errorf("[ERROR] Failed to exec query(update gpuResource): %w", err)
+
+		if err := lockGPUs(tx, gpus); err != nil {
+			return err
+		}
+
+		for _, victim := range victims {
+			if _, err := release(tx, store.PhasePreempted, releasePodSQL, victim.Namespace, victim.Name, "", ""); err != nil {
+				return err
+			}
 		}
+
+		var err error
+		ids, err = allocate(tx, podName, namespace, tenant, image, nodeName, gpuIndexes, vramReq)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	log.Println("[INFO] Allocate Resource, successfully")
+	log.Println("[INFO] Preempt Resource, successfully")
 
-	return nil
+	return ids, nil
 }
 
-func ReturnResource(clientset *kubernetes.Clientset, nodeName string, gpuIndex string, vramUsage int, vramRemain int, available int, vramReq int) error {
-	// Get DB Connector and Update DB
-	db, err := GetDBConnector(clientset)
-	if err != nil {
-		return fmt.Errorf("[ERROR] Failed to get db connector for returning resource: %w", err)
+func allocate(tx *sql.Tx, podName string, namespace string, tenant string, image string, nodeName string, gpuIndexes []string, vramReq int) ([]int64, error) {
+	if err := lockGPUs(tx, gpuKeys(nodeName, gpuIndexes)); err != nil {
+		return nil, err
 	}
 
-	// Update DB
-	if vramRemain == 0 {
-		updateSQL := "UPDATE gpuResource SET vram_usage = ?, vram_remain = ?, is_available = ? WHERE gpu_index = ? AND node_name = ?"
-		available = 1
+	var ids []int64
 
-		_, err = db.Exec(updateSQL, vramUsage-vramReq, vramRemain+vramReq, available, gpuIndex, nodeName)
+	for _, gpuIndex := range gpuIndexes {
+		// Update DB, only if gpu still has enough vram
+		res, err := tx.Exec(reserveUsageSQL, vramReq, vramReq, nodeName, gpuIndex, vramReq)
 		if err != nil {
-			return fmt.Errorf("[ERROR] Failed to exec query(update gpuResource): %w", err)
+			return nil, fmt.Errorf("[ERROR] Failed to exec query(update gpuResource): %w", err)
 		}
-	} else {
-		updateSQL := "UPDATE gpuResource SET vram_usage = ?, vram_remain = ? WHERE gpu_index = ? AND node_name = ?"
-		available = 1
 
-		_, err = db.Exec(updateSQL, vramUsage-vramReq, vramRemain+vramReq, gpuIndex, nodeName)
+		affected, err := res.RowsAffected()
 		if err != nil {
-			return fmt.Errorf("[ERROR] Failed to exec query(update gpuResource): %w", err)
+			return nil, fmt.Errorf("[ERROR] Failed to get affected rows: %w", err)
+		}
+
+		if affected == 0 {
+			return nil, store.ErrNoCapacity
 		}
+
+		// Record pod's allocation in ledger
+		id, err := insertAllocation(tx, podName, namespace, tenant, image, nodeName, gpuIndex, vramReq)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
 	}
 
-	log.Println("[INFO] Return Resource, successfully")
+	return ids, nil
+}
 
-	return nil
+// Release gives pod's outstanding allocations back to their gpus, their history ends with phase.
+// A podUID limits it to the allocations bound to that pod
+func (s *Store) Release(namespace string, podName string, podUID string, phase string) ([]conf.Allocation, error) {
+	return s.releaseAllocations(phase, releasePodSQL, namespace, podName, podUID, podUID)
 }
 
-func InsertNewResource(clientset *kubernetes.Clientset, hostName string, gpuIndex []string, vRAM []int) error {
-	// Firstly, Get DB Connector
-	db, err := GetDBConnector(clientset)
-	if err != nil {
-		return fmt.Errorf("[ERROR] Failed to get db connector for initializing db: %w", err)
+// BindPod binds pod's allocations reserved before it was created to its uid
+func (s *Store) BindPod(namespace string, podName string, podUID string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(bindPodSQL, podUID, namespace, podName); err != nil {
+			return fmt.Errorf("[ERROR] Failed to exec query(bind allocation): %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *Store) Rollback(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
 	}
 
-	// Thirdly, Extract column names and Insert initial data
-	var columns []string
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	selectSQL := `SELECT id, pod_name, namespace, tenant, node_name, gpu_index, vram, pod_uid FROM allocations
+			WHERE id IN (` + placeholders + `) AND released_at IS NULL`
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	_, err := s.releaseAllocations(store.PhaseRolledBack, selectSQL, args...)
+
+	return err
+}
 
-	selectColumnsSQL := `SELECT COLUMN_NAME
-        	FROM INFORMATION_SCHEMA.COLUMNS
-                WHERE TABLE_NAME = "gpuResource" AND COLUMN_NAME != "id";
-        `
+func (s *Store) releaseAllocations(phase string, selectSQL string, args ...interface{}) ([]conf.Allocation, error) {
+	var allocations []conf.Allocation
 
-	rows, err := db.Query(selectColumnsSQL)
+	err := s.inTx(func(tx *sql.Tx) (err error) {
+		allocations, err = release(tx, phase, selectSQL, args...)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("[ERROR] Failed to get rows from table: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var columnName string
-		if err := rows.Scan(&columnName); err != nil {
-			return fmt.Errorf("[ERROR] Failed to scan(column_name): %w", err)
-		}
-		columns = append(columns, columnName)
+	if len(allocations) > 0 {
+		log.Println("[INFO] Return Resource, successfully")
 	}
 
-	columnPlaceholders := ""
-	for i, column := range columns {
-		if i > 0 {
-			columnPlaceholders += ", "
-		}
-		columnPlaceholders += column
+	return allocations, nil
+}
+
+// release gives allocations selected by selectSQL back to their gpus, within tx.
+// selectSQL must not lock, allocations are locked only after their gpus
+func release(tx *sql.Tx, phase string, selectSQL string, args ...interface{}) ([]conf.Allocation, error) {
+	// Firstly, find out which gpus the outstanding allocations are on and lock them, as allocate does
+	allocations, err := selectAllocations(tx, selectSQL, args...)
+	if err != nil || len(allocations) == 0 {
+		return nil, err
+	}
+
+	if err = lockGPUs(tx, allocationGPUs(allocations)); err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < len(gpuIndex); i++ {
-		checkSQL := `SELECT COUNT(*) FROM gpuResource
-                        WHERE node_name = ? AND gpu_index = ?
-                `
+	// Secondly, lock the allocations, the ones released meanwhile aren't selected anymore
+	allocations, err = selectAllocations(tx, selectSQL+" FOR UPDATE", args...)
+	if err != nil || len(allocations) == 0 {
+		return nil, err
+	}
 
-		var count int
-		err = db.QueryRow(checkSQL, hostName, gpuIndex[i]).Scan(&count)
+	for _, allocation := range allocations {
+		// Thirdly, mark it released
+		_, err = tx.Exec(markReleasedSQL, allocation.ID)
 		if err != nil {
-			return fmt.Errorf("[ERROR] Failed to exec query(check values): %w", err)
+			return nil, fmt.Errorf("[ERROR] Failed to exec query(release allocation): %w", err)
 		}
 
-		if count > 0 {
-			continue
+		_, err = tx.Exec(endHistorySQL, phase, allocation.ID)
+		if err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to exec query(end allocation history): %w", err)
 		}
 
-		insertNewDataSQL := fmt.Sprintf(`
-			INSERT INTO gpuResource (%s) VALUES ("%s", "%s", %d, %d, %d, %d)
-                `, columnPlaceholders, hostName, gpuIndex[i], vRAM[i], 0, vRAM[i], 1)
-
-		_, err = db.Exec(insertNewDataSQL)
+		// Lastly, give vram back to the gpu
+		_, err = tx.Exec(subtractUsageSQL, allocation.VRAM, allocation.VRAM, allocation.NodeName, allocation.GPUIndex)
 		if err != nil {
-			return fmt.Errorf("[ERROR] Failed to exec query(insert values): %w", err)
+			return nil, fmt.Errorf("[ERROR] Failed to exec query(update gpuResource): %w", err)
 		}
 	}
 
+	return allocations, nil
+}
+
+func (s *Store) InsertResource(hostName string, devices []conf.GPUDevice) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err = upsertGPUs(tx, hostName, devices); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("[ERROR] Failed to commit gpu resources: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) RemoveNode(nodeName string) error {
+	deleteSQL := `DELETE FROM gpuResource WHERE node_name = ?`
+
+	_, err := s.db.Exec(deleteSQL, nodeName)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(delete gpuResource): %w", err)
+	}
+
+	log.Printf("[INFO] Remove gpu resources of [%s], successfully", nodeName)
+
+	return nil
+}
+
+// SetSchedulable marks node's gpus (un)schedulable, outstanding allocations are left untouched
+func (s *Store) SetSchedulable(nodeName string, schedulable bool) error {
+	updateSQL := `UPDATE gpuResource SET is_schedulable = ? WHERE node_name = ?`
+
+	_, err := s.db.Exec(updateSQL, schedulable, nodeName)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(update gpuResource): %w", err)
+	}
+
+	log.Printf("[INFO] Set gpu resources of [%s] schedulable=%t, successfully", nodeName, schedulable)
+
 	return nil
 }
@@ -0,0 +1,295 @@
+package mysql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	driver "github.com/go-sql-driver/mysql"
+	"resourceManager/conf"
+	"resourceManager/utils/store"
+)
+
+// openTestStore connects to the scratch database in RESOURCE_MANAGER_TEST_DSN, whose tables are dropped afterwards.
+// Tests against a real mysql are skipped without it
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	dsn := os.Getenv("RESOURCE_MANAGER_TEST_DSN")
+	if dsn == "" {
+		t.Skip("RESOURCE_MANAGER_TEST_DSN is not set")
+	}
+
+	config, err := driver.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("ParseDSN: %v", err)
+	}
+	config.ParseTime = true
+	applyUTC(config)
+
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	s := &Store{db: db}
+	if err = s.MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+
+	t.Cleanup(func() {
+		migrations, _ := LoadMigrations()
+		if err := s.MigrateDown(len(migrations)); err != nil {
+			t.Errorf("MigrateDown: %v", err)
+		}
+		db.Exec(`DROP TABLE IF EXISTS schema_migrations`)
+		db.Close()
+	})
+
+	return s
+}
+
+func TestAllocateConcurrent(t *testing.T) {
+	s := openTestStore(t)
+
+	var devices []conf.GPUDevice
+	for i := 0; i < 2; i++ {
+		devices = append(devices, conf.GPUDevice{Index: fmt.Sprint(i), MemoryMiB: 24576})
+	}
+	if err := s.InsertResource("node-a", devices); err != nil {
+		t.Fatalf("InsertResource: %v", err)
+	}
+
+	// Both gpus together hold 12 pods of 4 GiB, requests race for gpu 0 first and fall back to gpu 1
+	const requests = 50
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	placed := 0
+
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for _, gpuIndex := range []string{"0", "1"} {
+				_, err := s.Allocate(fmt.Sprintf("pod-%d", i), "xrcloud", "default", "busybox", "node-a", []string{gpuIndex}, 4096)
+				if errors.Is(err, store.ErrNoCapacity) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("Allocate: %v", err)
+					return
+				}
+
+				mu.Lock()
+				placed++
+				mu.Unlock()
+				return
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if placed != 12 {
+		t.Errorf("placed %d pods, want 12", placed)
+	}
+
+	results, err := s.ListResources()
+	if err != nil {
+		t.Fatalf("ListResources: %v", err)
+	}
+
+	for _, result := range results {
+		if result.VRAMUsage+result.VRAMRemain != result.TotalVRAM {
+			t.Errorf("gpu %s: usage %d + remain %d != total %d", result.GPUIndex, result.VRAMUsage, result.VRAMRemain, result.TotalVRAM)
+		}
+		if result.VRAMUsage > result.TotalVRAM {
+			t.Errorf("gpu %s is over-allocated: usage %d of %d", result.GPUIndex, result.VRAMUsage, result.TotalVRAM)
+		}
+	}
+
+	// Releasing in parallel returns every allocation exactly once
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.Release("xrcloud", fmt.Sprintf("pod-%d", i), "", "Succeeded"); err != nil {
+				t.Errorf("Release: %v", err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	results, err = s.ListResources()
+	if err != nil {
+		t.Fatalf("ListResources: %v", err)
+	}
+
+	for _, result := range results {
+		if result.VRAMUsage+result.VRAMRemain != result.TotalVRAM {
+			t.Errorf("gpu %s: usage %d + remain %d != total %d", result.GPUIndex, result.VRAMUsage, result.VRAMRemain, result.TotalVRAM)
+		}
+		if result.VRAMUsage != 0 {
+			t.Errorf("gpu %s: usage %d after every pod was released", result.GPUIndex, result.VRAMUsage)
+		}
+	}
+}
+
+// newOrderedMock expects statements exactly and in order, so tests see which rows are locked first
+func newOrderedMock(t *testing.T) (*Store, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &Store{db: db}, mock
+}
+
+var allocationColumns = []string{"id", "pod_name", "namespace", "tenant", "node_name", "gpu_index", "vram", "pod_uid"}
+
+func TestReleaseLocksGPUsBeforeAllocations(t *testing.T) {
+	s, mock := newOrderedMock(t)
+
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(allocationColumns).
+			AddRow(4, "pod", "xrcloud", "default", "node-a", "1", 2048, "uid-1").
+			AddRow(5, "pod", "xrcloud", "default", "node-a", "0", 2048, "uid-1")
+	}
+
+	// gpus are locked in sorted order as allocate locks them, then the allocations
+	mock.ExpectBegin()
+	mock.ExpectQuery(releasePodSQL).WithArgs("xrcloud", "pod", "uid-1", "uid-1").WillReturnRows(rows())
+	mock.ExpectQuery(lockGPUSQL).WithArgs("node-a", "0").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(lockGPUSQL).WithArgs("node-a", "1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery(releasePodSQL+" FOR UPDATE").WithArgs("xrcloud", "pod", "uid-1", "uid-1").WillReturnRows(rows())
+	for _, allocation := range []struct {
+		id       int64
+		gpuIndex string
+	}{{4, "1"}, {5, "0"}} {
+		mock.ExpectExec(markReleasedSQL).WithArgs(allocation.id).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(endHistorySQL).WithArgs("Failed", allocation.id).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(subtractUsageSQL).WithArgs(2048, 2048, "node-a", allocation.gpuIndex).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	allocations, err := s.Release("xrcloud", "pod", "uid-1", "Failed")
+	if err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if len(allocations) != 2 {
+		t.Errorf("Release returned %d allocations, want 2", len(allocations))
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAllocateRetriesDeadlock(t *testing.T) {
+	s, mock := newOrderedMock(t)
+
+	deadlock := &driver.MySQLError{Number: errDeadlock, Message: "Deadlock found when trying to get lock"}
+
+	// InnoDB rolls the victim back whole, it's run again from the start
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockGPUSQL).WithArgs("node-a", "0").WillReturnError(deadlock)
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockGPUSQL).WithArgs("node-a", "0").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(reserveUsageSQL).WithArgs(2048, 2048, "node-a", "0", 2048).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertAllocationSQL).WithArgs("pod", "xrcloud", "default", "node-a", "0", 2048).WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectExec(insertHistorySQL).WithArgs(int64(9), "pod", "xrcloud", "default", "busybox", "node-a", "0", 2048).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	ids, err := s.Allocate("pod", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 2048)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != 9 {
+		t.Errorf("Allocate returned ids %v, want [9]", ids)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAllocateGivesUpOnOtherErrors(t *testing.T) {
+	s, mock := newOrderedMock(t)
+
+	lost := &driver.MySQLError{Number: 2013, Message: "Lost connection to MySQL server during query"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockGPUSQL).WithArgs("node-a", "0").WillReturnError(lost)
+	mock.ExpectRollback()
+
+	_, err := s.Allocate("pod", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 2048)
+	if !isMySQLError(err, 2013) {
+		t.Errorf("Allocate error = %v, want the lost connection", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAllocateReleaseConcurrent(t *testing.T) {
+	s := openTestStore(t)
+
+	var devices []conf.GPUDevice
+	for i := 0; i < 4; i++ {
+		devices = append(devices, conf.GPUDevice{Index: fmt.Sprint(i), MemoryMiB: 24576})
+	}
+	if err := s.InsertResource("node-a", devices); err != nil {
+		t.Fatalf("InsertResource: %v", err)
+	}
+
+	// Pods over two gpus come and go, taking gpus in both orders while others release theirs
+	pairs := [][]string{{"0", "1"}, {"1", "0"}, {"2", "3"}, {"3", "2"}, {"1", "2"}}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 10; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for round := 0; round < 20; round++ {
+				podName := fmt.Sprintf("pod-%d-%d", worker, round)
+				_, err := s.Allocate(podName, "xrcloud", "default", "busybox", "node-a", pairs[(worker+round)%len(pairs)], 2048)
+				if err != nil && !errors.Is(err, store.ErrNoCapacity) {
+					t.Errorf("Allocate(%s): %v", podName, err)
+					return
+				}
+
+				if _, err = s.Release("xrcloud", podName, "", "Succeeded"); err != nil {
+					t.Errorf("Release(%s): %v", podName, err)
+					return
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+
+	results, err := s.ListResources()
+	if err != nil {
+		t.Fatalf("ListResources: %v", err)
+	}
+
+	for _, result := range results {
+		if result.VRAMUsage != 0 || result.VRAMRemain != result.TotalVRAM {
+			t.Errorf("gpu %s: usage %d, remain %d of %d after every pod was released", result.GPUIndex, result.VRAMUsage, result.VRAMRemain, result.TotalVRAM)
+		}
+	}
+}
@@ -4,44 +4,109 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"log"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	driver "github.com/go-sql-driver/mysql"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"resourceManager/conf"
+	"resourceManager/utils/store"
 )
 
-const (
-	NAMESPACE = "xrcloud"
-	DB_HOST   = "tcp(10.0.1.110:30306)"
-	DB_NAME   = "resourceBoard"
-	DB_USER   = "root"
-)
+var DB_Conn *sql.DB = nil
 
-var (
-	DB_PASS       string  = ""
-	DB_CONNECTION string  = ""
-	DB_Conn       *sql.DB = nil
-)
+// Store is the mysql backed store.ResourceStore
+type Store struct {
+	db *sql.DB
+}
+
+var _ store.ResourceStore = &Store{}
+
+// deadlockRetries is how many times a transaction InnoDB chose as deadlock victim is run again
+const deadlockRetries = 3
+
+// inTx runs fn in a transaction and commits it. Deadlock victims are rolled back whole, so they're simply run again
+func (s *Store) inTx(fn func(tx *sql.Tx) error) error {
+	var err error
+
+	for attempt := 0; attempt <= deadlockRetries; attempt++ {
+		if err = s.runTx(fn); !isMySQLError(err, errDeadlock) {
+			return err
+		}
+
+		log.Printf("[INFO] Transaction was chosen as deadlock victim, retrying")
+	}
+
+	return err
+}
+
+func (s *Store) runTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("[ERROR] Failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// NewStore reads user's password from k8s secret once, then opens the database
+func NewStore(clientset *kubernetes.Clientset) (*Store, error) {
+	db, err := GetDBConnector(clientset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// applyUTC makes NOW() and CURRENT_TIMESTAMP of the session UTC, the timezone DATETIME columns are read back in,
+// whatever the server's timezone is
+func applyUTC(dsn *driver.Config) {
+	dsn.Loc = time.UTC
+	if dsn.Params == nil {
+		dsn.Params = make(map[string]string)
+	}
+	dsn.Params["time_zone"] = "'+00:00'"
+}
 
 func GetDBConnector(clientset *kubernetes.Clientset) (*sql.DB, error) {
-	secretName := "mysql-root"
+	settings := conf.Get()
+
 	opts := metav1.GetOptions{}
-	secret, err := clientset.CoreV1().Secrets(NAMESPACE).Get(context.TODO(), secretName, opts)
+	secret, err := clientset.CoreV1().Secrets(settings.Namespace).Get(context.TODO(), settings.DB.PasswordSecret, opts)
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] Failed to get k8s secret: %w", err)
 	}
 
-	for key, value := range secret.Data {
-		if key == "password" {
-			DB_PASS = string(value)
-		}
-	}
-
-	DB_CONNECTION = DB_USER + ":" + DB_PASS + "@" + DB_HOST + "/" + DB_NAME
+	dsn := driver.NewConfig()
+	dsn.User = settings.DB.User
+	dsn.Passwd = string(secret.Data["password"])
+	dsn.Net = "tcp"
+	dsn.Addr = settings.DB.Host
+	dsn.DBName = settings.DB.Name
+	dsn.ParseTime = true
+	applyUTC(dsn)
 
 	if DB_Conn == nil {
-		DB_Conn, err = sql.Open("mysql", DB_CONNECTION)
+		DB_Conn, err = sql.Open("mysql", dsn.FormatDSN())
+		if err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to open database: %w", err)
+		}
 	}
 
 	return DB_Conn, nil
 }
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
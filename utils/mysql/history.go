@@ -0,0 +1,43 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"resourceManager/conf"
+)
+
+// ListHistory returns allocations which were outstanding at some point between from and to
+func (s *Store) ListHistory(from time.Time, to time.Time) ([]conf.AllocationRecord, error) {
+	selectSQL := `SELECT allocation_id, pod_name, namespace, tenant, image, node_name, gpu_index, vram, started_at, ended_at, phase
+			FROM allocation_history
+			WHERE started_at < ? AND (ended_at IS NULL OR ended_at > ?)
+			ORDER BY started_at`
+
+	rows, err := s.db.Query(selectSQL, to, from)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to get rows from table: %w", err)
+	}
+	defer rows.Close()
+
+	var results []conf.AllocationRecord
+
+	for rows.Next() {
+		var row conf.AllocationRecord
+		var endedAt sql.NullTime
+		if err = rows.Scan(&row.AllocationID, &row.PodName, &row.Namespace, &row.Tenant, &row.Image, &row.NodeName, &row.GPUIndex, &row.VRAM,
+			&row.StartedAt, &endedAt, &row.Phase); err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to scan allocation history: %w", err)
+		}
+
+		if endedAt.Valid {
+			row.EndedAt = &endedAt.Time
+		}
+
+		results = append(results, row)
+	}
+
+	return results, rows.Err()
+}
@@ -0,0 +1,77 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	_ "github.com/go-sql-driver/mysql"
+	"resourceManager/conf"
+)
+
+func (s *Store) ListAllocations() ([]conf.Allocation, error) {
+	selectSQL := `SELECT id, pod_name, namespace, tenant, node_name, gpu_index, vram, pod_uid, created_at FROM allocations WHERE released_at IS NULL`
+
+	rows, err := s.db.Query(selectSQL)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to get rows from table: %w", err)
+	}
+	defer rows.Close()
+
+	var results []conf.Allocation
+
+	for rows.Next() {
+		var row conf.Allocation
+		if err = rows.Scan(&row.ID, &row.PodName, &row.Namespace, &row.Tenant, &row.NodeName, &row.GPUIndex, &row.VRAM, &row.PodUID, &row.CreatedAt); err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to scan allocation: %w", err)
+		}
+
+		results = append(results, row)
+	}
+
+	return results, nil
+}
+
+// Record inserts allocation of an already running pod into ledger and adds it to gpuResource, in one transaction
+func (s *Store) Record(podName string, namespace string, tenant string, image string, nodeName string, gpuIndex string, vram int) error {
+	err := s.inTx(func(tx *sql.Tx) error {
+		// Running pod uses the vram whether it fits or not. Its gpu is locked first, as allocate does
+		if _, err := tx.Exec(addUsageSQL, vram, vram, nodeName, gpuIndex); err != nil {
+			return fmt.Errorf("[ERROR] Failed to exec query(update gpuResource): %w", err)
+		}
+
+		_, err := insertAllocation(tx, podName, namespace, tenant, image, nodeName, gpuIndex, vram)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Record allocation of pod %s/%s, successfully", namespace, podName)
+
+	return nil
+}
+
+// RecomputeUsage rebuilds every GPU's usage from the outstanding allocations in ledger
+func (s *Store) RecomputeUsage() error {
+	updateSQL := `
+		UPDATE gpuResource g
+		LEFT JOIN (
+			SELECT node_name, gpu_index, SUM(vram) AS used FROM allocations
+			WHERE released_at IS NULL
+			GROUP BY node_name, gpu_index
+		) a ON g.node_name = a.node_name AND g.gpu_index = a.gpu_index
+		SET g.vram_usage = COALESCE(a.used, 0),
+			g.vram_remain = g.total_vram - COALESCE(a.used, 0),
+			g.is_available = IF(g.total_vram - COALESCE(a.used, 0) > 0, 1, 0)
+	`
+
+	_, err := s.db.Exec(updateSQL)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(recompute usage): %w", err)
+	}
+
+	log.Println("[INFO] Recompute usage from allocation ledger, successfully")
+
+	return nil
+}
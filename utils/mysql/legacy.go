@@ -0,0 +1,167 @@
+package mysql
+
+import (
+	"fmt"
+	"log"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// upgradeLegacySchema brings databases created before migrations up to 0001_initial_schema.
+// Every step checks what's there already, so it's safe on any version of them
+func (s *Store) upgradeLegacySchema() error {
+	// Firstly, Create Table, Table Name : gpuResource
+	createTableSQL := `
+                CREATE TABLE IF NOT EXISTS gpuResource(
+                        id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+                        node_name VARCHAR(30) NOT NULL,
+                        gpu_index TINYINT NOT NULL,
+			total_vram INT NOT NULL,
+			vram_usage INT NOT NULL,
+			vram_remain INT NOT NULL,
+			is_available TINYINT(1) NOT NULL,
+			is_schedulable TINYINT(1) NOT NULL DEFAULT 1,
+			uuid VARCHAR(64) NOT NULL DEFAULT '',
+			model VARCHAR(128) NOT NULL DEFAULT '',
+			bus_id VARCHAR(32) NOT NULL DEFAULT '',
+			memory_mib INT NOT NULL DEFAULT 0
+                );
+        `
+
+	_, err := s.db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(create table): %w", err)
+	}
+
+	// Tables created before nodes could be cordoned lack is_schedulable
+	err = s.addColumn(`ALTER TABLE gpuResource ADD COLUMN is_schedulable TINYINT(1) NOT NULL DEFAULT 1`)
+	if err != nil {
+		return err
+	}
+
+	// Tables created before gpus' identity was discovered lack it, it's filled in on next discovery
+	identityColumns := []string{
+		`ALTER TABLE gpuResource ADD COLUMN uuid VARCHAR(64) NOT NULL DEFAULT ''`,
+		`ALTER TABLE gpuResource ADD COLUMN model VARCHAR(128) NOT NULL DEFAULT ''`,
+		`ALTER TABLE gpuResource ADD COLUMN bus_id VARCHAR(32) NOT NULL DEFAULT ''`,
+		`ALTER TABLE gpuResource ADD COLUMN memory_mib INT NOT NULL DEFAULT 0`,
+	}
+
+	for _, alterSQL := range identityColumns {
+		err = s.addColumn(alterSQL)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Secondly, Allocation ledger, Table Name : allocations
+	// Each pod's vram is recorded when it is created and released once when it finishes
+	createLedgerSQL := `
+		CREATE TABLE IF NOT EXISTS allocations(
+			id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			pod_name VARCHAR(253) NOT NULL,
+			namespace VARCHAR(63) NOT NULL,
+			tenant VARCHAR(63) NOT NULL DEFAULT '',
+			node_name VARCHAR(30) NOT NULL,
+			gpu_index TINYINT NOT NULL,
+			vram INT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			released_at DATETIME NULL
+		);
+	`
+
+	_, err = s.db.Exec(createLedgerSQL)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(create ledger): %w", err)
+	}
+
+	// Ledgers created before tenants lack tenant
+	err = s.addColumn(`ALTER TABLE allocations ADD COLUMN tenant VARCHAR(63) NOT NULL DEFAULT '' AFTER namespace`)
+	if err != nil {
+		return err
+	}
+
+	// Lastly, vram is accounted in MiB, tables of GiB times are converted once
+	err = s.convertVRAMToMiB()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// convertVRAMToMiB widens vram columns to INT and scales GiB rows by 1024. Rows are converted in one
+// transaction with a flag in schema_flags, so they're never scaled twice
+func (s *Store) convertVRAMToMiB() error {
+	createFlagsSQL := `CREATE TABLE IF NOT EXISTS schema_flags(name VARCHAR(64) NOT NULL PRIMARY KEY)`
+
+	_, err := s.db.Exec(createFlagsSQL)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(create schema flags): %w", err)
+	}
+
+	var count int
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM schema_flags WHERE name = 'vram_mib'`).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(check schema flags): %w", err)
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	// GiB values times 1024 overflow SMALLINT, columns are widened first
+	alterSQLs := []string{
+		`ALTER TABLE gpuResource MODIFY total_vram INT NOT NULL, MODIFY vram_usage INT NOT NULL, MODIFY vram_remain INT NOT NULL`,
+		`ALTER TABLE allocations MODIFY vram INT NOT NULL`,
+	}
+
+	for _, alterSQL := range alterSQLs {
+		if _, err = s.db.Exec(alterSQL); err != nil {
+			return fmt.Errorf("[ERROR] Failed to exec query(widen vram columns): %w", err)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Assignments are applied left to right, vram_remain is computed from the converted values.
+	// Exact memory from nvidia-smi replaces the rounded down total where it's known
+	updateResourceSQL := `UPDATE gpuResource SET
+			total_vram = IF(memory_mib > 0, memory_mib, total_vram * 1024),
+			vram_usage = vram_usage * 1024,
+			vram_remain = total_vram - vram_usage`
+
+	if _, err = tx.Exec(updateResourceSQL); err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(convert gpuResource to MiB): %w", err)
+	}
+
+	if _, err = tx.Exec(`UPDATE allocations SET vram = vram * 1024`); err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(convert allocations to MiB): %w", err)
+	}
+
+	if _, err = tx.Exec(`INSERT INTO schema_flags (name) VALUES ('vram_mib')`); err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(insert schema flag): %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("[ERROR] Failed to commit transaction: %w", err)
+	}
+
+	log.Println("[INFO] Convert vram of gpuResource and allocations to MiB, successfully")
+
+	return nil
+}
+
+// addColumn runs an ALTER TABLE ... ADD COLUMN, columns which exist already are left as they are
+func (s *Store) addColumn(alterSQL string) error {
+	_, err := s.db.Exec(alterSQL)
+	if err != nil && !isMySQLError(err, errDuplicateColumn) {
+		return fmt.Errorf("[ERROR] Failed to exec query(add column): %w", err)
+	}
+
+	return nil
+}
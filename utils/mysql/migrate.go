@@ -0,0 +1,324 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are NNNN_name.up.sql and NNNN_name.down.sql, applied in order of NNNN.
+// MySQL commits DDL right away, so each statement should be safe to run again when a migration fails halfway.
+// Indexes and columns can't say IF NOT EXISTS, adding one which exists or dropping one which doesn't is skipped instead
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const migrationLock = "resource_manager_migrate"
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+func LoadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to read migrations: %w", err)
+	}
+
+	migrations := make(map[int]*Migration)
+
+	for _, entry := range entries {
+		fileName := entry.Name()
+
+		base, direction, ok := strings.Cut(strings.TrimSuffix(fileName, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("[ERROR] Migration %s must end in .up.sql or .down.sql", fileName)
+		}
+
+		prefix, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("[ERROR] Migration %s must start with its version, e.g. 0001_", fileName)
+		}
+
+		data, err := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to read migration %s: %w", fileName, err)
+		}
+
+		migration, exists := migrations[version]
+		if !exists {
+			migration = &Migration{Version: version, Name: name}
+			migrations[version] = migration
+		}
+		if migration.Name != name {
+			return nil, fmt.Errorf("[ERROR] Migrations %s and %s share version %d", migration.Name, name, version)
+		}
+
+		if direction == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	var list []Migration
+	for _, migration := range migrations {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("[ERROR] Migration %04d_%s has no up.sql", migration.Version, migration.Name)
+		}
+		list = append(list, *migration)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+
+	return list, nil
+}
+
+// splitStatements splits a migration on semicolons ending a line, dropping "--" comments
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		current.WriteString(line)
+		current.WriteString("\n")
+
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+
+	return statements
+}
+
+// withMigrationLock runs fn on one connection holding a named lock, so replicas starting together don't migrate twice
+func (s *Store) withMigrationLock(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to get db connection: %w", err)
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 60)`, migrationLock).Scan(&locked)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(get migration lock): %w", err)
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return errors.New("[ERROR] Timed out waiting for migration lock")
+	}
+	defer conn.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, migrationLock)
+
+	createMigrationsSQL := `
+		CREATE TABLE IF NOT EXISTS schema_migrations(
+			version INT NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	if _, err = conn.ExecContext(ctx, createMigrationsSQL); err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(create schema_migrations): %w", err)
+	}
+
+	return fn(conn)
+}
+
+func appliedVersions(conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to exec query(select schema_migrations): %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to scan schema_migrations: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// bootstrapLegacy records 0001 as applied on databases created before migrations, once they're upgraded to it
+func (s *Store) bootstrapLegacy(conn *sql.Conn, applied map[int]time.Time) error {
+	if len(applied) > 0 {
+		return nil
+	}
+
+	var count int
+	err := conn.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM gpuResource`).Scan(&count)
+
+	if isMySQLError(err, errNoSuchTable) {
+		// It's a new database
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(check legacy schema): %w", err)
+	}
+
+	log.Println("[INFO] Database predates migrations, upgrading it to 0001_initial_schema")
+
+	if err = s.upgradeLegacySchema(); err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(context.Background(), `INSERT INTO schema_migrations (version, name) VALUES (1, 'initial_schema')`)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to exec query(record migration): %w", err)
+	}
+
+	applied[1] = time.Now()
+
+	return nil
+}
+
+// MigrateUp applies every migration not applied yet, it's run at startup
+func (s *Store) MigrateUp() error {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return s.withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+
+		if err = s.bootstrapLegacy(conn, applied); err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			for _, statement := range splitStatements(migration.Up) {
+				_, err = conn.ExecContext(context.Background(), statement)
+				if err != nil && !isMySQLError(err, errDuplicateKeyName) && !isMySQLError(err, errDuplicateColumn) {
+					return fmt.Errorf("[ERROR] Failed to apply migration %04d_%s: %w", migration.Version, migration.Name, err)
+				}
+			}
+
+			_, err = conn.ExecContext(context.Background(), `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("[ERROR] Failed to exec query(record migration): %w", err)
+			}
+
+			log.Printf("[INFO] Apply migration %04d_%s, successfully", migration.Version, migration.Name)
+		}
+
+		return nil
+	})
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first
+func (s *Store) MigrateDown(steps int) error {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return s.withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			if migration.Down == "" {
+				return fmt.Errorf("[ERROR] Migration %04d_%s can't be reverted, it has no down.sql", migration.Version, migration.Name)
+			}
+
+			for _, statement := range splitStatements(migration.Down) {
+				_, err = conn.ExecContext(context.Background(), statement)
+				if err != nil && !isMySQLError(err, errNoSuchKey) {
+					return fmt.Errorf("[ERROR] Failed to revert migration %04d_%s: %w", migration.Version, migration.Name, err)
+				}
+			}
+
+			_, err = conn.ExecContext(context.Background(), `DELETE FROM schema_migrations WHERE version = ?`, migration.Version)
+			if err != nil {
+				return fmt.Errorf("[ERROR] Failed to exec query(delete migration): %w", err)
+			}
+
+			log.Printf("[INFO] Revert migration %04d_%s, successfully", migration.Version, migration.Name)
+			steps--
+		}
+
+		return nil
+	})
+}
+
+// MigrationStatus lists every known migration, AppliedAt is nil for pending ones
+func (s *Store) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+
+	err = s.withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+			if appliedAt, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
@@ -0,0 +1,186 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	driver "github.com/go-sql-driver/mysql"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+
+	if len(migrations) == 0 || migrations[0].Name != "initial_schema" {
+		t.Fatalf("migrations start with %+v, want 0001_initial_schema", migrations)
+	}
+
+	for i, migration := range migrations {
+		// Versions follow each other, a gap is a migration which went missing
+		if migration.Version != i+1 {
+			t.Errorf("migration %d is %04d_%s, want version %d", i, migration.Version, migration.Name, i+1)
+		}
+		if migration.Name == "" {
+			t.Errorf("migration %04d has no name", migration.Version)
+		}
+		if len(splitStatements(migration.Up)) == 0 {
+			t.Errorf("migration %04d_%s has no up statements", migration.Version, migration.Name)
+		}
+		if len(splitStatements(migration.Down)) == 0 {
+			t.Errorf("migration %04d_%s has no down statements", migration.Version, migration.Name)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{name: "empty", script: "\n-- nothing yet\n\n"},
+		{name: "one per line", script: "CREATE INDEX a ON t (x);\nCREATE INDEX b ON t (y);\n", want: []string{"CREATE INDEX a ON t (x)", "CREATE INDEX b ON t (y)"}},
+		{name: "over several lines", script: "-- table\nCREATE TABLE t(\n\tid INT,\n\tname VARCHAR(30)\n);\n", want: []string{"CREATE TABLE t(\n\tid INT,\n\tname VARCHAR(30)\n)"}},
+		{name: "semicolon inside a line", script: "INSERT INTO t (name) VALUES ('a;b');\n", want: []string{"INSERT INTO t (name) VALUES ('a;b')"}},
+		{name: "last without semicolon", script: "DROP TABLE a;\nDROP TABLE b\n", want: []string{"DROP TABLE a", "DROP TABLE b"}},
+		{name: "indented comment", script: "SELECT 1;\n    -- trailing note\n", want: []string{"SELECT 1"}},
+	}
+
+	for _, test := range tests {
+		got := splitStatements(test.script)
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("%s: splitStatements = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBootstrapLegacy(t *testing.T) {
+	tests := []struct {
+		name        string
+		applied     map[int]time.Time
+		expect      func(mock sqlmock.Sqlmock)
+		wantApplied bool
+	}{
+		{
+			name:        "migrated already",
+			applied:     map[int]time.Time{1: time.Now()},
+			expect:      func(mock sqlmock.Sqlmock) {},
+			wantApplied: true,
+		},
+		{
+			name: "new database",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM gpuResource`).WillReturnError(&driver.MySQLError{Number: errNoSuchTable, Message: "Table 'gpuResource' doesn't exist"})
+			},
+		},
+		{
+			name: "legacy database in GiB",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectLegacyUpgrade(mock, false)
+			},
+			wantApplied: true,
+		},
+		{
+			name: "legacy database converted to MiB already",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectLegacyUpgrade(mock, true)
+			},
+			wantApplied: true,
+		},
+	}
+
+	for _, test := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("sqlmock.New: %v", err)
+		}
+
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatalf("Conn: %v", err)
+		}
+
+		applied := test.applied
+		if applied == nil {
+			applied = make(map[int]time.Time)
+		}
+		test.expect(mock)
+
+		s := &Store{db: db}
+		if err = s.bootstrapLegacy(conn, applied); err != nil {
+			t.Errorf("%s: bootstrapLegacy: %v", test.name, err)
+		}
+
+		if _, ok := applied[1]; ok != test.wantApplied {
+			t.Errorf("%s: 0001 applied = %t, want %t", test.name, ok, test.wantApplied)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		conn.Close()
+		db.Close()
+	}
+}
+
+// expectLegacyUpgrade expects upgradeLegacySchema on tables which have some of the later columns already,
+// then 0001 being recorded
+func expectLegacyUpgrade(mock sqlmock.Sqlmock, converted bool) {
+	ok := sqlmock.NewResult(0, 0)
+	duplicate := &driver.MySQLError{Number: errDuplicateColumn, Message: "Duplicate column name"}
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM gpuResource`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS gpuResource`).WillReturnResult(ok)
+	mock.ExpectExec(`ADD COLUMN is_schedulable`).WillReturnError(duplicate)
+	for _, column := range []string{"uuid", "model", "bus_id", "memory_mib"} {
+		mock.ExpectExec(`ADD COLUMN ` + column).WillReturnResult(ok)
+	}
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS allocations`).WillReturnResult(ok)
+	mock.ExpectExec(`ADD COLUMN tenant`).WillReturnError(duplicate)
+
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_flags`).WillReturnResult(ok)
+	if converted {
+		mock.ExpectQuery(`FROM schema_flags WHERE name = 'vram_mib'`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	} else {
+		mock.ExpectQuery(`FROM schema_flags WHERE name = 'vram_mib'`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectExec(`ALTER TABLE gpuResource MODIFY total_vram INT`).WillReturnResult(ok)
+		mock.ExpectExec(`ALTER TABLE allocations MODIFY vram INT`).WillReturnResult(ok)
+		mock.ExpectBegin()
+		mock.ExpectExec(`UPDATE gpuResource SET`).WillReturnResult(ok)
+		mock.ExpectExec(`UPDATE allocations SET vram = vram \* 1024`).WillReturnResult(ok)
+		mock.ExpectExec(`INSERT INTO schema_flags \(name\) VALUES \('vram_mib'\)`).WillReturnResult(ok)
+		mock.ExpectCommit()
+	}
+
+	mock.ExpectExec(`INSERT INTO schema_migrations \(version, name\) VALUES \(1, 'initial_schema'\)`).WillReturnResult(ok)
+}
+
+func TestWidenNodeName(t *testing.T) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+
+	// Every table with node_name ends up holding any node name kubernetes allows
+	widened := make(map[string]bool)
+	for _, migration := range migrations {
+		for _, statement := range splitStatements(migration.Up) {
+			if strings.Contains(statement, "MODIFY node_name VARCHAR(253)") {
+				widened[strings.Fields(statement)[2]] = true
+			}
+		}
+	}
+
+	for _, table := range []string{"gpuResource", "allocations", "allocation_history"} {
+		if !widened[table] {
+			t.Errorf("node_name of %s isn't widened to VARCHAR(253)", table)
+		}
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS allocations;
+DROP TABLE IF EXISTS gpuResource;
@@ -0,0 +1,28 @@
+-- gpus of every gpushare node, vram in MiB
+CREATE TABLE IF NOT EXISTS gpuResource(
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	node_name VARCHAR(30) NOT NULL,
+	gpu_index TINYINT NOT NULL,
+	total_vram INT NOT NULL,
+	vram_usage INT NOT NULL,
+	vram_remain INT NOT NULL,
+	is_available TINYINT(1) NOT NULL,
+	is_schedulable TINYINT(1) NOT NULL DEFAULT 1,
+	uuid VARCHAR(64) NOT NULL DEFAULT '',
+	model VARCHAR(128) NOT NULL DEFAULT '',
+	bus_id VARCHAR(32) NOT NULL DEFAULT '',
+	memory_mib INT NOT NULL DEFAULT 0
+);
+
+-- Allocation ledger, each pod's vram is recorded when it is created and released once when it finishes
+CREATE TABLE IF NOT EXISTS allocations(
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	pod_name VARCHAR(253) NOT NULL,
+	namespace VARCHAR(63) NOT NULL,
+	tenant VARCHAR(63) NOT NULL DEFAULT '',
+	node_name VARCHAR(30) NOT NULL,
+	gpu_index TINYINT NOT NULL,
+	vram INT NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	released_at DATETIME NULL
+);
@@ -0,0 +1,26 @@
+-- Every allocation ever made, kept after its pod is gone for usage accounting, vram in MiB
+CREATE TABLE IF NOT EXISTS allocation_history(
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	allocation_id INT NOT NULL,
+	pod_name VARCHAR(253) NOT NULL,
+	namespace VARCHAR(63) NOT NULL,
+	tenant VARCHAR(63) NOT NULL DEFAULT '',
+	image VARCHAR(512) NOT NULL DEFAULT '',
+	node_name VARCHAR(30) NOT NULL,
+	gpu_index TINYINT NOT NULL,
+	vram INT NOT NULL,
+	started_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	ended_at DATETIME NULL,
+	phase VARCHAR(32) NOT NULL DEFAULT '',
+	UNIQUE KEY allocation_history_allocation (allocation_id),
+	KEY allocation_history_started (started_at),
+	KEY allocation_history_ended (ended_at)
+);
+
+-- Allocations made before history was kept, their image and exit phase are unknown
+INSERT INTO allocation_history (allocation_id, pod_name, namespace, tenant, node_name, gpu_index, vram, started_at, ended_at, phase)
+SELECT a.id, a.pod_name, a.namespace, a.tenant, a.node_name, a.gpu_index, a.vram, a.created_at, a.released_at,
+	IF(a.released_at IS NULL, '', 'Unknown')
+FROM allocations a
+LEFT JOIN allocation_history h ON h.allocation_id = a.id
+WHERE h.id IS NULL;
@@ -0,0 +1,2 @@
+DROP INDEX allocations_pod ON allocations;
+DROP INDEX gpuResource_node_gpu ON gpuResource;
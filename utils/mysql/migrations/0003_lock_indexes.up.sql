@@ -0,0 +1,3 @@
+-- Allocating and releasing lock rows through these, without them every statement scans and locks the whole table
+CREATE INDEX gpuResource_node_gpu ON gpuResource (node_name, gpu_index);
+CREATE INDEX allocations_pod ON allocations (namespace, pod_name);
@@ -0,0 +1,3 @@
+-- Allocations are bound to their pod's uid once it's created, so a late event of an earlier pod of the same name
+-- doesn't release a newer one's vram
+ALTER TABLE allocations ADD COLUMN pod_uid VARCHAR(36) NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- Fails while any node's name is longer than 30 characters
+ALTER TABLE allocation_history MODIFY node_name VARCHAR(30) NOT NULL;
+ALTER TABLE allocations MODIFY node_name VARCHAR(30) NOT NULL;
+ALTER TABLE gpuResource MODIFY node_name VARCHAR(30) NOT NULL;
@@ -0,0 +1,4 @@
+-- Node names are DNS subdomains of up to 253 characters, VARCHAR(30) cut longer ones off or rejected them
+ALTER TABLE gpuResource MODIFY node_name VARCHAR(253) NOT NULL;
+ALTER TABLE allocations MODIFY node_name VARCHAR(253) NOT NULL;
+ALTER TABLE allocation_history MODIFY node_name VARCHAR(253) NOT NULL;
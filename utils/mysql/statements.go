@@ -0,0 +1,201 @@
+package mysql
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+
+	driver "github.com/go-sql-driver/mysql"
+	"resourceManager/conf"
+)
+
+// Every value is passed as a placeholder argument, never formatted into sql.
+// Column lists are spelled out, so statements don't depend on column order of older tables
+
+const (
+	insertAllocationSQL = `INSERT INTO allocations (pod_name, namespace, tenant, node_name, gpu_index, vram)
+			VALUES (?, ?, ?, ?, ?, ?)`
+
+	insertHistorySQL = `INSERT INTO allocation_history (allocation_id, pod_name, namespace, tenant, image, node_name, gpu_index, vram)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	// Pod's uid is bound twice, empty uid selects every allocation of the name
+	releasePodSQL = `SELECT id, pod_name, namespace, tenant, node_name, gpu_index, vram, pod_uid FROM allocations
+			WHERE namespace = ? AND pod_name = ? AND (? = '' OR pod_uid = ?) AND released_at IS NULL
+			ORDER BY id`
+
+	bindPodSQL = `UPDATE allocations SET pod_uid = ?
+			WHERE namespace = ? AND pod_name = ? AND pod_uid = '' AND released_at IS NULL`
+
+	lockGPUSQL = `SELECT id FROM gpuResource WHERE node_name = ? AND gpu_index = ? FOR UPDATE`
+
+	endHistorySQL = `UPDATE allocation_history SET ended_at = NOW(), phase = ? WHERE allocation_id = ? AND ended_at IS NULL`
+
+	addUsageSQL = `UPDATE gpuResource
+			SET vram_usage = vram_usage + ?, vram_remain = vram_remain - ?, is_available = IF(vram_remain > 0, 1, 0)
+			WHERE node_name = ? AND gpu_index = ?`
+
+	// reserveUsageSQL changes nothing unless the gpu still has enough vram, allocate checks rows affected
+	reserveUsageSQL = `UPDATE gpuResource
+			SET vram_usage = vram_usage + ?, vram_remain = vram_remain - ?, is_available = IF(vram_remain > 0, 1, 0)
+			WHERE node_name = ? AND gpu_index = ? AND is_available = 1 AND is_schedulable = 1 AND vram_remain >= ?`
+
+	subtractUsageSQL = `UPDATE gpuResource
+			SET vram_usage = vram_usage - ?, vram_remain = vram_remain + ?, is_available = IF(vram_remain > 0, 1, 0)
+			WHERE node_name = ? AND gpu_index = ?`
+
+	markReleasedSQL = `UPDATE allocations SET released_at = NOW() WHERE id = ?`
+
+	countGPUSQL = `SELECT COUNT(*) FROM gpuResource WHERE node_name = ? AND gpu_index = ?`
+
+	updateGPUIdentitySQL = `UPDATE gpuResource SET uuid = ?, model = ?, bus_id = ?, memory_mib = ?
+			WHERE node_name = ? AND gpu_index = ?`
+
+	insertGPUSQL = `INSERT INTO gpuResource (node_name, gpu_index, total_vram, vram_usage, vram_remain, is_available, is_schedulable,
+			uuid, model, bus_id, memory_mib)
+			VALUES (?, ?, ?, 0, ?, 1, 1, ?, ?, ?, ?)`
+)
+
+const (
+	errNoSuchTable      = 1146
+	errDuplicateColumn  = 1060
+	errDuplicateKeyName = 1061
+	errNoSuchKey        = 1091
+	errDeadlock         = 1213
+)
+
+func isMySQLError(err error, number uint16) bool {
+	var mysqlErr *driver.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == number
+}
+
+// gpuKey names a gpu as its rows in gpuResource and allocations do
+type gpuKey struct {
+	nodeName string
+	gpuIndex string
+}
+
+func gpuKeys(nodeName string, gpuIndexes []string) []gpuKey {
+	var keys []gpuKey
+	for _, gpuIndex := range gpuIndexes {
+		keys = append(keys, gpuKey{nodeName, gpuIndex})
+	}
+	return keys
+}
+
+func allocationGPUs(allocations []conf.Allocation) []gpuKey {
+	var keys []gpuKey
+	for _, allocation := range allocations {
+		keys = append(keys, gpuKey{allocation.NodeName, allocation.GPUIndex})
+	}
+	return keys
+}
+
+// lockGPUs locks gpus' rows in sorted order. Transactions lock gpus before any allocation of theirs,
+// so allocating and releasing never wait for each other's rows the other way round
+func lockGPUs(tx *sql.Tx, gpus []gpuKey) error {
+	sorted := slices.Clone(gpus)
+	slices.SortFunc(sorted, func(a, b gpuKey) int {
+		return cmp.Or(cmp.Compare(a.nodeName, b.nodeName), cmp.Compare(a.gpuIndex, b.gpuIndex))
+	})
+
+	for _, gpu := range slices.Compact(sorted) {
+		var id int
+		err := tx.QueryRow(lockGPUSQL, gpu.nodeName, gpu.gpuIndex).Scan(&id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("[ERROR] Failed to exec query(lock gpuResource): %w", err)
+		}
+	}
+
+	return nil
+}
+
+// selectAllocations reads allocations selected by selectSQL, within tx
+func selectAllocations(tx *sql.Tx, selectSQL string, args ...interface{}) ([]conf.Allocation, error) {
+	rows, err := tx.Query(selectSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to exec query(select allocation): %w", err)
+	}
+	defer rows.Close()
+
+	var allocations []conf.Allocation
+
+	for rows.Next() {
+		var allocation conf.Allocation
+		if err = rows.Scan(&allocation.ID, &allocation.PodName, &allocation.Namespace, &allocation.Tenant, &allocation.NodeName, &allocation.GPUIndex, &allocation.VRAM, &allocation.PodUID); err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to scan allocation: %w", err)
+		}
+		allocations = append(allocations, allocation)
+	}
+
+	return allocations, rows.Err()
+}
+
+// insertAllocation records allocation in ledger and starts its history entry, it's run in allocation's transaction
+func insertAllocation(tx *sql.Tx, podName string, namespace string, tenant string, image string, nodeName string, gpuIndex string, vram int) (int64, error) {
+	res, err := tx.Exec(insertAllocationSQL, podName, namespace, tenant, nodeName, gpuIndex, vram)
+	if err != nil {
+		return 0, fmt.Errorf("[ERROR] Failed to exec query(insert allocation): %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("[ERROR] Failed to get allocation id: %w", err)
+	}
+
+	_, err = tx.Exec(insertHistorySQL, id, podName, namespace, tenant, image, nodeName, gpuIndex, vram)
+	if err != nil {
+		return 0, fmt.Errorf("[ERROR] Failed to exec query(insert allocation history): %w", err)
+	}
+
+	return id, nil
+}
+
+// upsertGPUs inserts new gpus of node, known ones only get their identity refreshed and their usage is kept.
+// Statements are prepared once for all of node's gpus
+func upsertGPUs(tx *sql.Tx, nodeName string, devices []conf.GPUDevice) error {
+	countStmt, err := tx.Prepare(countGPUSQL)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to prepare query(check values): %w", err)
+	}
+	defer countStmt.Close()
+
+	updateStmt, err := tx.Prepare(updateGPUIdentitySQL)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to prepare query(update gpu identity): %w", err)
+	}
+	defer updateStmt.Close()
+
+	insertStmt, err := tx.Prepare(insertGPUSQL)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to prepare query(insert values): %w", err)
+	}
+	defer insertStmt.Close()
+
+	for _, device := range devices {
+		var count int
+		if err = countStmt.QueryRow(nodeName, device.Index).Scan(&count); err != nil {
+			return fmt.Errorf("[ERROR] Failed to exec query(check values): %w", err)
+		}
+
+		if count > 0 {
+			_, err = updateStmt.Exec(device.UUID, device.Model, device.BusID, device.MemoryMiB, nodeName, device.Index)
+			if err != nil {
+				return fmt.Errorf("[ERROR] Failed to exec query(update gpu identity): %w", err)
+			}
+			continue
+		}
+
+		// New gpus are schedulable with all of their memory free
+		vram := device.MemoryMiB
+
+		_, err = insertStmt.Exec(nodeName, device.Index, vram, vram, device.UUID, device.Model, device.BusID, device.MemoryMiB)
+		if err != nil {
+			return fmt.Errorf("[ERROR] Failed to exec query(insert values): %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package mysql
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	driver "github.com/go-sql-driver/mysql"
+	"resourceManager/conf"
+)
+
+var hostileNames = []string{
+	`node'a`,
+	`node"a`,
+	`node\'a`,
+	`node\`,
+	`"); DROP TABLE gpuResource; --`,
+	`'); DROP TABLE allocations; --`,
+}
+
+// newMockStore fails the test whenever a value shows up in sql text rather than as a bound argument
+func newMockStore(t *testing.T, name string) (*Store, sqlmock.Sqlmock) {
+	t.Helper()
+
+	matcher := sqlmock.QueryMatcherFunc(func(expectedSQL string, actualSQL string) error {
+		if strings.Contains(actualSQL, name) {
+			return fmt.Errorf("node name %q was formatted into sql: %s", name, actualSQL)
+		}
+		return sqlmock.QueryMatcherRegexp.Match(regexp.QuoteMeta(expectedSQL), actualSQL)
+	})
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(matcher))
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &Store{db: db}, mock
+}
+
+func TestInsertResourceBindsNodeName(t *testing.T) {
+	for _, name := range hostileNames {
+		t.Run(name, func(t *testing.T) {
+			s, mock := newMockStore(t, name)
+
+			devices := []conf.GPUDevice{
+				{Index: "0", UUID: "GPU-0", Model: "NVIDIA A100", BusID: "00000000:17:00.0", MemoryMiB: 40960},
+				{Index: "1", UUID: "GPU-1", Model: "NVIDIA A100", BusID: "00000000:65:00.0", MemoryMiB: 40960},
+			}
+
+			mock.ExpectBegin()
+			countStmt := mock.ExpectPrepare(countGPUSQL)
+			updateStmt := mock.ExpectPrepare(updateGPUIdentitySQL)
+			insertStmt := mock.ExpectPrepare(insertGPUSQL)
+
+			// gpu 0 is new, gpu 1 is known already
+			countStmt.ExpectQuery().WithArgs(name, "0").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			insertStmt.ExpectExec().WithArgs(name, "0", 40960, 40960, "GPU-0", "NVIDIA A100", "00000000:17:00.0", 40960).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			countStmt.ExpectQuery().WithArgs(name, "1").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			updateStmt.ExpectExec().WithArgs("GPU-1", "NVIDIA A100", "00000000:65:00.0", 40960, name, "1").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			if err := s.InsertResource(name, devices); err != nil {
+				t.Fatalf("InsertResource: %v", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestAllocateBindsNodeName(t *testing.T) {
+	for _, name := range hostileNames {
+		t.Run(name, func(t *testing.T) {
+			s, mock := newMockStore(t, name)
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockGPUSQL).WithArgs(name, "0").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			mock.ExpectExec(reserveUsageSQL).WithArgs(2048, 2048, name, "0", 2048).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(insertAllocationSQL).WithArgs("pod", "xrcloud", name, name, "0", 2048).WillReturnResult(sqlmock.NewResult(7, 1))
+			mock.ExpectExec(insertHistorySQL).WithArgs(int64(7), "pod", "xrcloud", name, name, name, "0", 2048).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			// Tenant and image are user input as well
+			ids, err := s.Allocate("pod", "xrcloud", name, name, name, []string{"0"}, 2048)
+			if err != nil {
+				t.Fatalf("Allocate: %v", err)
+			}
+			if len(ids) != 1 || ids[0] != 7 {
+				t.Errorf("Allocate returned ids %v, want [7]", ids)
+			}
+
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRecordBindsNodeName(t *testing.T) {
+	for _, name := range hostileNames {
+		t.Run(name, func(t *testing.T) {
+			s, mock := newMockStore(t, name)
+
+			mock.ExpectBegin()
+			mock.ExpectExec(addUsageSQL).WithArgs(2048, 2048, name, "0").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(insertAllocationSQL).WithArgs(name, "xrcloud", "default", name, "0", 2048).WillReturnResult(sqlmock.NewResult(3, 1))
+			mock.ExpectExec(insertHistorySQL).WithArgs(int64(3), name, "xrcloud", "default", "busybox", name, "0", 2048).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			if err := s.Record(name, "xrcloud", "default", "busybox", name, "0", 2048); err != nil {
+				t.Fatalf("Record: %v", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestAddColumn(t *testing.T) {
+	const alterSQL = `ALTER TABLE gpuResource ADD COLUMN uuid VARCHAR(64) NOT NULL DEFAULT ''`
+
+	otherErr := errors.New("connection reset")
+
+	tests := []struct {
+		name    string
+		execErr error
+		wantErr error
+	}{
+		{"added", nil, nil},
+		{"duplicate column", &driver.MySQLError{Number: errDuplicateColumn, Message: "Duplicate column name 'uuid'"}, nil},
+		{"no such table", &driver.MySQLError{Number: errNoSuchTable, Message: "Table 'gpuResource' doesn't exist"}, &driver.MySQLError{Number: errNoSuchTable}},
+		{"other error", otherErr, otherErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("sqlmock.New: %v", err)
+			}
+			defer db.Close()
+
+			expect := mock.ExpectExec(alterSQL)
+			if tt.execErr != nil {
+				expect.WillReturnError(tt.execErr)
+			} else {
+				expect.WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+
+			err = (&Store{db: db}).addColumn(alterSQL)
+
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Errorf("addColumn: %v, want nil", err)
+				}
+			case *driver.MySQLError:
+				if !isMySQLError(err, want.Number) {
+					t.Errorf("addColumn: %v, want mysql error %d", err, want.Number)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Errorf("addColumn: %v, want %v", err, want)
+				}
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -1,41 +1,95 @@
 package nvidia
 
 import (
-	"os/exec"
-	"regexp"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
 	"strconv"
+	"strings"
+
+	"resourceManager/conf"
 )
 
-func GetGPUMemoryPerIndex(server string, password string) ([]string, []int, error) {
-	var ids []string
-	var vram []int
+const queryGPUCommand = "nvidia-smi --query-gpu=index,uuid,name,memory.total,pci.bus_id --format=csv"
+
+// ParseGPUQuery reads the csv of queryGPUCommand. Columns are found by header, so their order doesn't matter
+func ParseGPUQuery(output []byte) ([]conf.GPUDevice, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(output, []byte("\xef\xbb\xbf"))))
+	reader.TrimLeadingSpace = true
 
-	indexoutput, err := exec.Command("sshpass", "-p", password, "ssh", "-o StrictHostKeyChecking=no", "root@"+server, "nvidia-smi --query-gpu=index --format=csv,noheader").Output()
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("[ERROR] Empty nvidia-smi output")
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("[ERROR] Failed to parse nvidia-smi output: %w", err)
 	}
 
-	for i, id := range indexoutput {
-		if i%2 == 0 {
-			ids = append(ids, string(id))
-			memoutput, err := exec.Command("sshpass", "-p", password, "ssh", "-o StrictHostKeyChecking=no", "root@"+server, "nvidia-smi -i "+string(id)+" --query-gpu=memory.total --format=csv").Output()
-			if err != nil {
-				return nil, nil, err
-			}
-
-			outputStr := string(memoutput)
-
-			re := regexp.MustCompile(`(\d+)\s+MiB`)
-			match := re.FindStringSubmatch(outputStr)
-			if len(match) > 1 {
-				memoryMIB, err := strconv.Atoi(match[1])
-				if err != nil {
-					return nil, nil, err
-				}
-				vram = append(vram, memoryMIB/1024)
-			}
+	// Header names carry units, e.g. "memory.total [MiB]"
+	columns := make(map[string]int)
+	for i, name := range header {
+		name, _, _ = strings.Cut(strings.TrimSpace(name), " ")
+		columns[name] = i
+	}
+
+	for _, name := range []string{"index", "uuid", "name", "memory.total", "pci.bus_id"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("[ERROR] Column %s not found in nvidia-smi output", name)
 		}
 	}
 
-	return ids, vram, nil
+	var devices []conf.GPUDevice
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to parse nvidia-smi output: %w", err)
+		}
+
+		field := func(name string) string {
+			return strings.TrimSpace(record[columns[name]])
+		}
+
+		memory := strings.TrimSpace(strings.TrimSuffix(field("memory.total"), "MiB"))
+		memoryMiB, err := strconv.Atoi(memory)
+		if err != nil {
+			return nil, fmt.Errorf("[ERROR] Unexpected memory %q of gpu %s in nvidia-smi output", field("memory.total"), field("index"))
+		}
+
+		devices = append(devices, conf.GPUDevice{
+			Index:     field("index"),
+			UUID:      field("uuid"),
+			Model:     field("name"),
+			BusID:     field("pci.bus_id"),
+			MemoryMiB: memoryMiB,
+		})
+	}
+
+	return devices, nil
+}
+
+// GetGPUDevices queries every gpu of the server at once
+func GetGPUDevices(runner CommandRunner) ([]conf.GPUDevice, error) {
+	output, err := runner.Run(queryGPUCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseGPUQuery(output)
+}
+
+// DiscoverGPUs connects to the server once and queries its gpus over that connection
+func DiscoverGPUs(host string, password string) ([]conf.GPUDevice, error) {
+	runner, err := DialSSH(host, password)
+	if err != nil {
+		return nil, err
+	}
+	defer runner.Close()
+
+	return GetGPUDevices(runner)
 }
@@ -0,0 +1,142 @@
+package nvidia
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"resourceManager/conf"
+)
+
+// Captured from `nvidia-smi --query-gpu=index,uuid,name,memory.total,pci.bus_id --format=csv`
+const (
+	sampleA100 = "index, uuid, name, memory.total [MiB], pci.bus_id\n" +
+		"0, GPU-3f1b4c2e-8d9a-4e6f-b1c2-7a8b9c0d1e2f, NVIDIA A100-SXM4-40GB, 40960 MiB, 00000000:07:00.0\n" +
+		"1, GPU-9e8d7c6b-5a4f-4e3d-a2c1-0b9a8f7e6d5c, NVIDIA A100-SXM4-40GB, 40960 MiB, 00000000:0F:00.0\n"
+
+	// DGX-2 has 16 gpus
+	sampleDGX2 = "index, uuid, name, memory.total [MiB], pci.bus_id\n" +
+		"0, GPU-6b0fd2a1-7c3e-4f5d-9a8b-000000000000, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:34:00.0\n" +
+		"1, GPU-6b0fd2a1-7c3e-4f5d-9a8b-000000000001, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:36:00.0\n" +
+		"2, GPU-6b0fd2a1-7c3e-4f5d-9a8b-000000000002, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:39:00.0\n" +
+		"3, GPU-6b0fd2a1-7c3e-4f5d-9a8b-000000000003, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:3B:00.0\n" +
+		"4, GPU-6b0fd2a1-7c3e-4f5d-9a8b-000000000004, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:57:00.0\n" +
+		"5, GPU-6b0fd2a1-7c3e-4f5d-9a8b-000000000005, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:59:00.0\n" +
+		"6, GPU-6b0fd2a1-7c3e-4f5d-9a8b-000000000006, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:5C:00.0\n" +
+		"7, GPU-6b0fd2a1-7c3e-4f5d-9a8b-000000000007, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:5E:00.0\n" +
+		"8, GPU-6b0fd2a1-7c3e-4f5d-9a8b-000000000008, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:B7:00.0\n" +
+		"9, GPU-6b0fd2a1-7c3e-4f5d-9a8b-000000000009, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:B9:00.0\n" +
+		"10, GPU-6b0fd2a1-7c3e-4f5d-9a8b-00000000000a, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:BC:00.0\n" +
+		"11, GPU-6b0fd2a1-7c3e-4f5d-9a8b-00000000000b, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:BE:00.0\n" +
+		"12, GPU-6b0fd2a1-7c3e-4f5d-9a8b-00000000000c, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:E0:00.0\n" +
+		"13, GPU-6b0fd2a1-7c3e-4f5d-9a8b-00000000000d, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:E2:00.0\n" +
+		"14, GPU-6b0fd2a1-7c3e-4f5d-9a8b-00000000000e, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:E5:00.0\n" +
+		"15, GPU-6b0fd2a1-7c3e-4f5d-9a8b-00000000000f, Tesla V100-SXM3-32GB, 32768 MiB, 00000000:E7:00.0\n"
+
+	// Windows hosts end lines with CRLF and may prefix a byte order mark
+	sampleWindows = "\xef\xbb\xbfindex, uuid, name, memory.total [MiB], pci.bus_id\r\n" +
+		"0, GPU-0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d, NVIDIA GeForce RTX 3090, 24576 MiB, 00000000:01:00.0\r\n"
+
+	sampleReordered = "pci.bus_id, memory.total [MiB], name, uuid, index\n" +
+		"00000000:3B:00.0, 46068 MiB, NVIDIA RTX A6000, GPU-5d4c3b2a-1f0e-4d9c-8b7a-6f5e4d3c2b1a, 0\n" +
+		"00000000:AF:00.0, 46068 MiB, NVIDIA RTX A6000, GPU-a1b2c3d4-e5f6-4a7b-8c9d-0e1f2a3b4c5d, 1\n"
+
+	// GPUs which fell off the bus report [N/A]
+	sampleNotAvailable = "index, uuid, name, memory.total [MiB], pci.bus_id\n" +
+		"0, GPU-3f1b4c2e-8d9a-4e6f-b1c2-7a8b9c0d1e2f, NVIDIA A100-SXM4-40GB, 40960 MiB, 00000000:07:00.0\n" +
+		"1, [N/A], [N/A], [N/A], 00000000:0F:00.0\n"
+
+	sampleShortRow = "index, uuid, name, memory.total [MiB], pci.bus_id\n" +
+		"0, GPU-3f1b4c2e-8d9a-4e6f-b1c2-7a8b9c0d1e2f, NVIDIA A100-SXM4-40GB\n"
+
+	sampleBrokenQuote = "index, uuid, name, memory.total [MiB], pci.bus_id\n" +
+		"0, GPU-3f1b4c2e-8d9a-4e6f-b1c2-7a8b9c0d1e2f, \"NVIDIA A100, 40960 MiB, 00000000:07:00.0\n"
+
+	sampleMissingColumn = "index, uuid, name, memory.total [MiB]\n" +
+		"0, GPU-3f1b4c2e-8d9a-4e6f-b1c2-7a8b9c0d1e2f, NVIDIA A100-SXM4-40GB, 40960 MiB\n"
+
+	// nvidia-smi prints its error on stdout when the driver isn't loaded
+	sampleNoDriver = "NVIDIA-SMI has failed because it couldn't communicate with the NVIDIA driver. " +
+		"Make sure that the latest NVIDIA driver is installed and running.\n"
+)
+
+func TestParseGPUQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    []conf.GPUDevice
+		wantLen int
+		wantErr string
+	}{
+		{
+			name:   "a100",
+			output: sampleA100,
+			want: []conf.GPUDevice{
+				{Index: "0", UUID: "GPU-3f1b4c2e-8d9a-4e6f-b1c2-7a8b9c0d1e2f", Model: "NVIDIA A100-SXM4-40GB", BusID: "00000000:07:00.0", MemoryMiB: 40960},
+				{Index: "1", UUID: "GPU-9e8d7c6b-5a4f-4e3d-a2c1-0b9a8f7e6d5c", Model: "NVIDIA A100-SXM4-40GB", BusID: "00000000:0F:00.0", MemoryMiB: 40960},
+			},
+		},
+		{
+			name:    "16 gpus",
+			output:  sampleDGX2,
+			wantLen: 16,
+		},
+		{
+			name:   "crlf and bom",
+			output: sampleWindows,
+			want: []conf.GPUDevice{
+				{Index: "0", UUID: "GPU-0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d", Model: "NVIDIA GeForce RTX 3090", BusID: "00000000:01:00.0", MemoryMiB: 24576},
+			},
+		},
+		{
+			name:   "reordered columns",
+			output: sampleReordered,
+			want: []conf.GPUDevice{
+				{Index: "0", UUID: "GPU-5d4c3b2a-1f0e-4d9c-8b7a-6f5e4d3c2b1a", Model: "NVIDIA RTX A6000", BusID: "00000000:3B:00.0", MemoryMiB: 46068},
+				{Index: "1", UUID: "GPU-a1b2c3d4-e5f6-4a7b-8c9d-0e1f2a3b4c5d", Model: "NVIDIA RTX A6000", BusID: "00000000:AF:00.0", MemoryMiB: 46068},
+			},
+		},
+		{
+			name:   "header only",
+			output: "index, uuid, name, memory.total [MiB], pci.bus_id\n",
+		},
+		{name: "memory not available", output: sampleNotAvailable, wantErr: `Unexpected memory "[N/A]" of gpu 1`},
+		{name: "short row", output: sampleShortRow, wantErr: "wrong number of fields"},
+		{name: "broken quote", output: sampleBrokenQuote, wantErr: "Failed to parse nvidia-smi output"},
+		{name: "missing column", output: sampleMissingColumn, wantErr: "Column pci.bus_id not found"},
+		{name: "driver not loaded", output: sampleNoDriver, wantErr: "Column index not found"},
+		{name: "empty", output: "", wantErr: "Empty nvidia-smi output"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices, err := ParseGPUQuery([]byte(tt.output))
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseGPUQuery error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseGPUQuery: %v", err)
+			}
+
+			if tt.want != nil {
+				if fmt.Sprint(devices) != fmt.Sprint(tt.want) {
+					t.Errorf("ParseGPUQuery = %+v, want %+v", devices, tt.want)
+				}
+				return
+			}
+
+			if len(devices) != tt.wantLen {
+				t.Fatalf("ParseGPUQuery returned %d gpus, want %d", len(devices), tt.wantLen)
+			}
+			for i, device := range devices {
+				if device.Index != fmt.Sprint(i) || device.MemoryMiB != 32768 || device.Model != "Tesla V100-SXM3-32GB" {
+					t.Errorf("gpu %d = %+v", i, device)
+				}
+			}
+		})
+	}
+}
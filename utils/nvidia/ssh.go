@@ -0,0 +1,120 @@
+package nvidia
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"resourceManager/conf"
+)
+
+// CommandRunner runs commands on a gpu server, tests feed canned output through it
+type CommandRunner interface {
+	Run(command string) ([]byte, error)
+	Close() error
+}
+
+// SSHRunner keeps one connection to the server, every command runs in its own session on it
+type SSHRunner struct {
+	host    string
+	client  *ssh.Client
+	timeout time.Duration
+}
+
+var _ CommandRunner = &SSHRunner{}
+
+// DialSSH connects to host with the configured private key, falling back to password when it's given.
+// Host key must be in known_hosts
+func DialSSH(host string, password string) (*SSHRunner, error) {
+	settings := conf.Get().SSH
+
+	hostKeyCallback, err := knownhosts.New(settings.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to load known hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+
+	if settings.PrivateKey != "" {
+		key, err := os.ReadFile(settings.PrivateKey)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && password != "":
+			log.Printf("[INFO] No ssh private key at %s, using password for %s", settings.PrivateKey, host)
+		case err != nil:
+			return nil, fmt.Errorf("[ERROR] Failed to read ssh private key: %w", err)
+		default:
+			signer, err := ssh.ParsePrivateKey(key)
+			if err != nil {
+				return nil, fmt.Errorf("[ERROR] Failed to parse ssh private key: %w", err)
+			}
+
+			auth = append(auth, ssh.PublicKeys(signer))
+		}
+	}
+
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("[ERROR] No ssh private key nor password for %s", host)
+	}
+
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, "22"), &ssh.ClientConfig{
+		User:            settings.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         time.Duration(settings.Timeout),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to connect to %s: %w", host, err)
+	}
+
+	return &SSHRunner{
+		host:    host,
+		client:  client,
+		timeout: time.Duration(settings.CommandTimeout),
+	}, nil
+}
+
+func (r *SSHRunner) Run(command string) ([]byte, error) {
+	session, err := r.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to open ssh session to %s: %w", r.host, err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(r.timeout):
+		// Closing the session makes Run return, the command is abandoned on the server
+		session.Close()
+		return nil, fmt.Errorf("[ERROR] Command %q on %s timed out after %s", command, r.host, r.timeout)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Command %q on %s failed: %w: %s", command, r.host, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (r *SSHRunner) Close() error {
+	return r.client.Close()
+}
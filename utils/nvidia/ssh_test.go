@@ -0,0 +1,87 @@
+package nvidia
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeRunner answers every command with canned output, in place of a server over ssh
+type fakeRunner struct {
+	output   string
+	err      error
+	commands []string
+	closed   bool
+}
+
+func (r *fakeRunner) Run(command string) ([]byte, error) {
+	r.commands = append(r.commands, command)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return []byte(r.output), nil
+}
+
+func (r *fakeRunner) Close() error {
+	r.closed = true
+	return nil
+}
+
+var _ CommandRunner = &fakeRunner{}
+
+func TestGetGPUDevices(t *testing.T) {
+	exitErr := errors.New(`[ERROR] Command "nvidia-smi" on 10.0.1.21 failed: Process exited with status 127: bash: nvidia-smi: command not found`)
+	timeoutErr := errors.New(`[ERROR] Command "nvidia-smi" on 10.0.1.21 timed out after 30s`)
+
+	tests := []struct {
+		name     string
+		runner   *fakeRunner
+		wantGPUs int
+		wantErr  error
+		wantMsg  string
+	}{
+		{name: "a100", runner: &fakeRunner{output: sampleA100}, wantGPUs: 2},
+		{name: "16 gpus", runner: &fakeRunner{output: sampleDGX2}, wantGPUs: 16},
+		{name: "command failed", runner: &fakeRunner{err: exitErr}, wantErr: exitErr},
+		{name: "timed out", runner: &fakeRunner{err: timeoutErr}, wantErr: timeoutErr},
+		{name: "empty output", runner: &fakeRunner{output: ""}, wantMsg: "Empty nvidia-smi output"},
+		{name: "driver not loaded", runner: &fakeRunner{output: sampleNoDriver}, wantMsg: "Column index not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices, err := GetGPUDevices(tt.runner)
+
+			if len(tt.runner.commands) != 1 || tt.runner.commands[0] != queryGPUCommand {
+				t.Errorf("ran %q, want a single %q", tt.runner.commands, queryGPUCommand)
+			}
+
+			// Connection belongs to the caller
+			if tt.runner.closed {
+				t.Error("GetGPUDevices closed the runner")
+			}
+
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("GetGPUDevices error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantMsg != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantMsg) {
+					t.Errorf("GetGPUDevices error = %v, want %q", err, tt.wantMsg)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("GetGPUDevices: %v", err)
+				}
+				if len(devices) != tt.wantGPUs {
+					t.Errorf("GetGPUDevices returned %d gpus, want %d", len(devices), tt.wantGPUs)
+				}
+			}
+
+			if err != nil && devices != nil {
+				t.Errorf("GetGPUDevices returned %v along with error", devices)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package store
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"resourceManager/conf"
+)
+
+// MemoryStore keeps everything in process, it's used for dev mode and unit tests
+type MemoryStore struct {
+	mu          sync.Mutex
+	resources   []*conf.GPUResource
+	allocations []*conf.Allocation
+	released    map[int64]bool
+	history     []*conf.AllocationRecord
+	nextID      int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		released: make(map[int64]bool),
+	}
+}
+
+func (m *MemoryStore) Init() error {
+	return nil
+}
+
+func (m *MemoryStore) InsertResource(nodeName string, devices []conf.GPUDevice) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, device := range devices {
+		// Known gpus only get their identity refreshed, their usage is kept
+		if resource := m.findResource(nodeName, device.Index); resource != nil {
+			resource.UUID = device.UUID
+			resource.Model = device.Model
+			resource.BusID = device.BusID
+			resource.MemoryMiB = device.MemoryMiB
+			continue
+		}
+
+		vram := device.MemoryMiB
+
+		m.resources = append(m.resources, &conf.GPUResource{
+			NodeName:      nodeName,
+			GPUIndex:      device.Index,
+			TotalVRAM:     vram,
+			VRAMUsage:     0,
+			VRAMRemain:    vram,
+			IsAvailable:   vram > 0,
+			IsSchedulable: true,
+			UUID:          device.UUID,
+			Model:         device.Model,
+			BusID:         device.BusID,
+			MemoryMiB:     device.MemoryMiB,
+		})
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) ListResources() ([]conf.GPUResource, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []conf.GPUResource
+	for _, resource := range m.resources {
+		results = append(results, *resource)
+	}
+
+	return results, nil
+}
+
+func (m *MemoryStore) ListAllocations() ([]conf.Allocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []conf.Allocation
+	for _, allocation := range m.allocations {
+		if !m.released[allocation.ID] {
+			results = append(results, *allocation)
+		}
+	}
+
+	return results, nil
+}
+
+func (m *MemoryStore) Allocate(podName string, namespace string, tenant string, image string, nodeName string, gpuIndexes []string, vram int) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.fits(nodeName, gpuIndexes, vram, nil) {
+		return nil, ErrNoCapacity
+	}
+
+	var ids []int64
+
+	for _, gpuIndex := range gpuIndexes {
+		resource := m.findResource(nodeName, gpuIndex)
+		resource.VRAMUsage += vram
+		resource.VRAMRemain -= vram
+		resource.IsAvailable = resource.VRAMRemain > 0
+
+		ids = append(ids, m.record(podName, namespace, tenant, image, nodeName, gpuIndex, vram))
+	}
+
+	log.Println("[INFO] Allocate Resource, successfully")
+
+	return ids, nil
+}
+
+func (m *MemoryStore) Record(podName string, namespace string, tenant string, image string, nodeName string, gpuIndex string, vram int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.record(podName, namespace, tenant, image, nodeName, gpuIndex, vram)
+
+	// Running pod uses the vram whether it fits or not
+	if resource := m.findResource(nodeName, gpuIndex); resource != nil {
+		resource.VRAMUsage += vram
+		resource.VRAMRemain -= vram
+		resource.IsAvailable = resource.VRAMRemain > 0
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) Release(namespace string, podName string, podUID string, phase string) ([]conf.Allocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var released []conf.Allocation
+	for _, allocation := range m.allocations {
+		if allocation.Namespace == namespace && allocation.PodName == podName && (podUID == "" || allocation.PodUID == podUID) && !m.released[allocation.ID] {
+			m.release(allocation, phase)
+			released = append(released, *allocation)
+		}
+	}
+
+	return released, nil
+}
+
+func (m *MemoryStore) BindPod(namespace string, podName string, podUID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, allocation := range m.allocations {
+		if allocation.Namespace == namespace && allocation.PodName == podName && allocation.PodUID == "" && !m.released[allocation.ID] {
+			allocation.PodUID = podUID
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) Preempt(victims []PodRef, podName string, namespace string, tenant string, image string, nodeName string, gpuIndexes []string, vram int) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var freed []*conf.Allocation
+	for _, allocation := range m.allocations {
+		if m.released[allocation.ID] {
+			continue
+		}
+		for _, victim := range victims {
+			if allocation.Namespace == victim.Namespace && allocation.PodName == victim.Name {
+				freed = append(freed, allocation)
+				break
+			}
+		}
+	}
+
+	// Check against the vram victims give back, before anything is released
+	if !m.fits(nodeName, gpuIndexes, vram, freed) {
+		return nil, ErrNoCapacity
+	}
+
+	for _, allocation := range freed {
+		m.release(allocation, PhasePreempted)
+	}
+
+	var ids []int64
+	for _, gpuIndex := range gpuIndexes {
+		resource := m.findResource(nodeName, gpuIndex)
+		resource.VRAMUsage += vram
+		resource.VRAMRemain -= vram
+		resource.IsAvailable = resource.VRAMRemain > 0
+
+		ids = append(ids, m.record(podName, namespace, tenant, image, nodeName, gpuIndex, vram))
+	}
+
+	return ids, nil
+}
+
+func (m *MemoryStore) Rollback(ids []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range ids {
+		for _, allocation := range m.allocations {
+			if allocation.ID == id && !m.released[id] {
+				m.release(allocation, PhaseRolledBack)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) RemoveNode(nodeName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []*conf.GPUResource
+	for _, resource := range m.resources {
+		if resource.NodeName != nodeName {
+			kept = append(kept, resource)
+		}
+	}
+	m.resources = kept
+
+	return nil
+}
+
+func (m *MemoryStore) SetSchedulable(nodeName string, schedulable bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, resource := range m.resources {
+		if resource.NodeName == nodeName {
+			resource.IsSchedulable = schedulable
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) ListHistory(from time.Time, to time.Time) ([]conf.AllocationRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []conf.AllocationRecord
+	for _, record := range m.history {
+		if record.StartedAt.Before(to) && (record.EndedAt == nil || record.EndedAt.After(from)) {
+			results = append(results, *record)
+		}
+	}
+
+	return results, nil
+}
+
+func (m *MemoryStore) RecomputeUsage() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, resource := range m.resources {
+		resource.VRAMUsage = 0
+		for _, allocation := range m.allocations {
+			if allocation.NodeName == resource.NodeName && allocation.GPUIndex == resource.GPUIndex && !m.released[allocation.ID] {
+				resource.VRAMUsage += allocation.VRAM
+			}
+		}
+		resource.VRAMRemain = resource.TotalVRAM - resource.VRAMUsage
+		resource.IsAvailable = resource.VRAMRemain > 0
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// fits tells whether every gpu holds vram once freed allocations are given back
+func (m *MemoryStore) fits(nodeName string, gpuIndexes []string, vram int, freed []*conf.Allocation) bool {
+	for _, gpuIndex := range gpuIndexes {
+		resource := m.findResource(nodeName, gpuIndex)
+		if resource == nil || !resource.IsSchedulable {
+			return false
+		}
+
+		remain := resource.VRAMRemain
+		for _, allocation := range freed {
+			if allocation.NodeName == nodeName && allocation.GPUIndex == gpuIndex {
+				remain += allocation.VRAM
+			}
+		}
+
+		if remain <= 0 || remain < vram {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *MemoryStore) findResource(nodeName string, gpuIndex string) *conf.GPUResource {
+	for _, resource := range m.resources {
+		if resource.NodeName == nodeName && resource.GPUIndex == gpuIndex {
+			return resource
+		}
+	}
+
+	return nil
+}
+
+// record adds allocation to ledger and starts its history entry, it returns allocation's id
+func (m *MemoryStore) record(podName string, namespace string, tenant string, image string, nodeName string, gpuIndex string, vram int) int64 {
+	now := time.Now()
+
+	m.nextID++
+	m.allocations = append(m.allocations, &conf.Allocation{
+		ID:        m.nextID,
+		PodName:   podName,
+		Namespace: namespace,
+		Tenant:    tenant,
+		NodeName:  nodeName,
+		GPUIndex:  gpuIndex,
+		VRAM:      vram,
+		CreatedAt: now,
+	})
+
+	m.history = append(m.history, &conf.AllocationRecord{
+		AllocationID: m.nextID,
+		PodName:      podName,
+		Namespace:    namespace,
+		Tenant:       tenant,
+		Image:        image,
+		NodeName:     nodeName,
+		GPUIndex:     gpuIndex,
+		VRAM:         vram,
+		StartedAt:    now,
+	})
+
+	return m.nextID
+}
+
+func (m *MemoryStore) release(allocation *conf.Allocation, phase string) {
+	m.released[allocation.ID] = true
+
+	for _, record := range m.history {
+		if record.AllocationID == allocation.ID {
+			endedAt := time.Now()
+			record.EndedAt = &endedAt
+			record.Phase = phase
+			break
+		}
+	}
+
+	if resource := m.findResource(allocation.NodeName, allocation.GPUIndex); resource != nil {
+		resource.VRAMUsage -= allocation.VRAM
+		resource.VRAMRemain += allocation.VRAM
+		resource.IsAvailable = resource.VRAMRemain > 0
+	}
+
+	log.Println("[INFO] Return Resource, successfully")
+}
@@ -0,0 +1,284 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"resourceManager/conf"
+)
+
+func newTestMemoryStore(t *testing.T) *MemoryStore {
+	t.Helper()
+
+	m := NewMemoryStore()
+	devices := []conf.GPUDevice{
+		{Index: "0", MemoryMiB: 24576},
+		{Index: "1", MemoryMiB: 24576},
+	}
+	if err := m.InsertResource("node-a", devices); err != nil {
+		t.Fatalf("InsertResource: %v", err)
+	}
+
+	return m
+}
+
+func usageOf(t *testing.T, m *MemoryStore, gpuIndex string) conf.GPUResource {
+	t.Helper()
+
+	results, err := m.ListResources()
+	if err != nil {
+		t.Fatalf("ListResources: %v", err)
+	}
+
+	for _, result := range results {
+		if result.GPUIndex == gpuIndex {
+			return result
+		}
+	}
+
+	t.Fatalf("gpu %s not found", gpuIndex)
+	return conf.GPUResource{}
+}
+
+func TestAllocateAllOrNothing(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	if _, err := m.Allocate("a", "xrcloud", "default", "busybox", "node-a", []string{"1"}, 20480); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	// gpu 1 can't hold it, so gpu 0 isn't reserved either
+	if _, err := m.Allocate("b", "xrcloud", "default", "busybox", "node-a", []string{"0", "1"}, 8192); err != ErrNoCapacity {
+		t.Fatalf("Allocate error = %v, want ErrNoCapacity", err)
+	}
+
+	if usage := usageOf(t, m, "0"); usage.VRAMUsage != 0 {
+		t.Errorf("gpu 0 usage = %d after failed allocation, want 0", usage.VRAMUsage)
+	}
+}
+
+func TestReleaseIdempotent(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	if _, err := m.Allocate("pod", "xrcloud", "default", "busybox", "node-a", []string{"0", "1"}, 8192); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	released, err := m.Release("xrcloud", "pod", "", "Succeeded")
+	if err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if len(released) != 2 {
+		t.Fatalf("Release returned %d allocations, want 2", len(released))
+	}
+
+	// Informer, api and reconciler may all release the same pod
+	for i := 0; i < 3; i++ {
+		released, err = m.Release("xrcloud", "pod", "", "Succeeded")
+		if err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+		if len(released) != 0 {
+			t.Errorf("Release returned %d allocations again, want none", len(released))
+		}
+	}
+
+	for _, gpuIndex := range []string{"0", "1"} {
+		if usage := usageOf(t, m, gpuIndex); usage.VRAMUsage != 0 || usage.VRAMRemain != 24576 {
+			t.Errorf("gpu %s: usage %d, remain %d after release", gpuIndex, usage.VRAMUsage, usage.VRAMRemain)
+		}
+	}
+}
+
+func TestReleaseOtherNamespace(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	if _, err := m.Allocate("pod", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 8192); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	// Same pod name in another namespace is a different pod
+	released, _ := m.Release("other", "pod", "", "Succeeded")
+	if len(released) != 0 {
+		t.Errorf("Release in other namespace returned %d allocations, want none", len(released))
+	}
+
+	if usage := usageOf(t, m, "0"); usage.VRAMUsage != 8192 {
+		t.Errorf("gpu 0 usage = %d, want 8192", usage.VRAMUsage)
+	}
+}
+
+func TestReleaseLeavesNewerPodOfSameName(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	if _, err := m.Allocate("pod", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 8192); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if err := m.BindPod("xrcloud", "pod", "uid-1"); err != nil {
+		t.Fatalf("BindPod: %v", err)
+	}
+	if released, _ := m.Release("xrcloud", "pod", "uid-1", "Succeeded"); len(released) != 1 {
+		t.Fatalf("Release(uid-1) returned %d allocations, want 1", len(released))
+	}
+
+	// Pod is created again under the same name, first its reservation and then the pod
+	if _, err := m.Allocate("pod", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 4096); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if released, _ := m.Release("xrcloud", "pod", "uid-1", "Succeeded"); len(released) != 0 {
+		t.Errorf("late Release(uid-1) released %d allocations of the reservation, want none", len(released))
+	}
+
+	if err := m.BindPod("xrcloud", "pod", "uid-2"); err != nil {
+		t.Fatalf("BindPod: %v", err)
+	}
+	if released, _ := m.Release("xrcloud", "pod", "uid-1", "Succeeded"); len(released) != 0 {
+		t.Errorf("late Release(uid-1) released %d allocations of the newer pod, want none", len(released))
+	}
+	if usage := usageOf(t, m, "0"); usage.VRAMUsage != 4096 {
+		t.Errorf("gpu 0 usage = %d, want 4096", usage.VRAMUsage)
+	}
+
+	if released, _ := m.Release("xrcloud", "pod", "uid-2", "Succeeded"); len(released) != 1 || released[0].PodUID != "uid-2" {
+		t.Errorf("Release(uid-2) = %+v, want its allocation", released)
+	}
+}
+
+func TestRollbackIdempotent(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	ids, err := m.Allocate("pod", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 8192)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	if err = m.Rollback(ids); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	// Rolled back allocations aren't released again
+	if err = m.Rollback(ids); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if released, _ := m.Release("xrcloud", "pod", "", "Succeeded"); len(released) != 0 {
+		t.Errorf("Release after rollback returned %d allocations, want none", len(released))
+	}
+
+	if usage := usageOf(t, m, "0"); usage.VRAMUsage != 0 || usage.VRAMRemain != 24576 {
+		t.Errorf("gpu 0: usage %d, remain %d after rollback", usage.VRAMUsage, usage.VRAMRemain)
+	}
+
+	history, _ := m.ListHistory(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if len(history) != 1 || history[0].Phase != PhaseRolledBack {
+		t.Errorf("history = %+v, want one entry rolled back", history)
+	}
+}
+
+func TestRecomputeUsage(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	if _, err := m.Allocate("a", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 4096); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if _, err := m.Allocate("b", "xrcloud", "default", "busybox", "node-a", []string{"0", "1"}, 2048); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if _, err := m.Release("xrcloud", "a", "", "Succeeded"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	// Usage drifted away from ledger, e.g. by a crash in the middle of an update
+	m.mu.Lock()
+	for _, resource := range m.resources {
+		resource.VRAMUsage = 99999
+		resource.VRAMRemain = -1
+		resource.IsAvailable = false
+	}
+	m.mu.Unlock()
+
+	if err := m.RecomputeUsage(); err != nil {
+		t.Fatalf("RecomputeUsage: %v", err)
+	}
+
+	for _, gpuIndex := range []string{"0", "1"} {
+		usage := usageOf(t, m, gpuIndex)
+		if usage.VRAMUsage != 2048 || usage.VRAMRemain != 22528 || !usage.IsAvailable {
+			t.Errorf("gpu %s = %+v, want usage 2048, remain 22528", gpuIndex, usage)
+		}
+	}
+}
+
+func TestPreempt(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	if _, err := m.Allocate("low", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 20480); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	// Evicting low isn't enough for 2 gpus of 24 GiB, since gpu 1 is taken as well
+	if _, err := m.Allocate("other", "xrcloud", "default", "busybox", "node-a", []string{"1"}, 8192); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	_, err := m.Preempt([]PodRef{{"xrcloud", "low"}}, "high", "xrcloud", "default", "busybox", "node-a", []string{"0", "1"}, 24576)
+	if err != ErrNoCapacity {
+		t.Fatalf("Preempt error = %v, want ErrNoCapacity", err)
+	}
+	if usage := usageOf(t, m, "0"); usage.VRAMUsage != 20480 {
+		t.Errorf("gpu 0 usage = %d after failed preemption, want 20480", usage.VRAMUsage)
+	}
+
+	ids, err := m.Preempt([]PodRef{{"xrcloud", "low"}}, "high", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 16384)
+	if err != nil {
+		t.Fatalf("Preempt: %v", err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("Preempt returned %d allocations, want 1", len(ids))
+	}
+
+	// Freed vram went to high, it can't be taken by anyone else
+	if _, err = m.Allocate("late", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 16384); err != ErrNoCapacity {
+		t.Errorf("Allocate after preemption error = %v, want ErrNoCapacity", err)
+	}
+	if usage := usageOf(t, m, "0"); usage.VRAMUsage != 16384 || usage.VRAMRemain != 8192 {
+		t.Errorf("gpu 0: usage %d, remain %d, want 16384 and 8192", usage.VRAMUsage, usage.VRAMRemain)
+	}
+
+	// Victim's own release, once its pod is gone, returns nothing
+	if released, _ := m.Release("xrcloud", "low", "", "Failed"); len(released) != 0 {
+		t.Errorf("Release of victim returned %d allocations, want none", len(released))
+	}
+
+	history, _ := m.ListHistory(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	for _, record := range history {
+		if record.PodName == "low" && record.Phase != PhasePreempted {
+			t.Errorf("victim's history phase = %q, want %q", record.Phase, PhasePreempted)
+		}
+	}
+}
+
+func TestRecordAddsUsage(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	if _, err := m.Allocate("a", "xrcloud", "default", "busybox", "node-a", []string{"0"}, 20480); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	// Adopted pods are recorded even when they don't fit
+	if err := m.Record("b", "xrcloud", "default", "busybox", "node-a", "0", 8192); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	usage := usageOf(t, m, "0")
+	if usage.VRAMUsage != 28672 || usage.VRAMRemain != -4096 || usage.IsAvailable {
+		t.Errorf("gpu 0 = %+v, want usage 28672, remain -4096, unavailable", usage)
+	}
+
+	// Unknown gpus keep the allocation only
+	if err := m.Record("c", "xrcloud", "default", "busybox", "node-z", "0", 8192); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	allocations, _ := m.ListAllocations()
+	if len(allocations) != 3 {
+		t.Errorf("%d allocations, want 3", len(allocations))
+	}
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"resourceManager/conf"
+)
+
+var ErrNoCapacity = errors.New("[ERROR] Not enough vram remains on gpu")
+
+// Phases recorded in history for allocations which didn't end with their pod's own phase
+const (
+	PhaseRolledBack = "RolledBack" // pod couldn't be created
+	PhaseCancelled  = "Cancelled"  // group was given up before it was placed
+	PhaseGone       = "Gone"       // pod disappeared while nobody was watching
+	PhasePreempted  = "Preempted"  // pod was evicted for a higher priority one
+	PhaseReconciled = "Reconciled" // ledger held other vram than the pod uses, it was recorded again
+)
+
+// PodRef names a pod whose allocations are kept in ledger
+type PodRef struct {
+	Namespace string
+	Name      string
+}
+
+// ResourceStore keeps gpu resources and the per-pod allocation ledger
+type ResourceStore interface {
+	// Init prepares the backend, e.g. creates tables
+	Init() error
+
+	// InsertResource adds node's gpus which aren't stored yet
+	InsertResource(nodeName string, devices []conf.GPUDevice) error
+
+	ListResources() ([]conf.GPUResource, error)
+
+	// ListAllocations returns allocations which aren't released yet
+	ListAllocations() ([]conf.Allocation, error)
+
+	// Allocate reserves vram on every gpu of the node and records them for the pod, all or nothing.
+	// It returns ErrNoCapacity when any gpu no longer has enough vram remaining
+	Allocate(podName string, namespace string, tenant string, image string, nodeName string, gpuIndexes []string, vram int) ([]int64, error)
+
+	// Release gives pod's vram back exactly once, it returns nothing when there is nothing left to release.
+	// A podUID limits it to allocations bound to that pod, so a late event of an earlier pod of the same name
+	// leaves a newer one's vram alone. Empty podUID releases every allocation of the name.
+	// Phase is how the pod ended, it's kept in history
+	Release(namespace string, podName string, podUID string, phase string) ([]conf.Allocation, error)
+
+	// BindPod binds pod's allocations which aren't bound yet to its uid, once the pod is created
+	BindPod(namespace string, podName string, podUID string) error
+
+	// Record adds allocation of a pod which is already running and its vram to the gpu's usage, without checking
+	// capacity, so the gpu may end up over-committed. Gpus which aren't stored are left alone, the allocation is kept anyway
+	Record(podName string, namespace string, tenant string, image string, nodeName string, gpuIndex string, vram int) error
+
+	// Preempt releases victims' vram and reserves it for the pod on the node's gpus, all or nothing, so nobody
+	// else can take it in between. It returns ErrNoCapacity, releasing nothing, when the gpus still can't hold the pod
+	Preempt(victims []PodRef, podName string, namespace string, tenant string, image string, nodeName string, gpuIndexes []string, vram int) ([]int64, error)
+
+	// Rollback releases allocations whose pod couldn't be created
+	Rollback(ids []int64) error
+
+	// RemoveNode deletes node's gpus
+	RemoveNode(nodeName string) error
+
+	// SetSchedulable keeps node's gpus from (or lets them back into) placement
+	SetSchedulable(nodeName string, schedulable bool) error
+
+	// ListHistory returns every allocation, released or not, which was outstanding between from and to
+	ListHistory(from time.Time, to time.Time) ([]conf.AllocationRecord, error)
+
+	// RecomputeUsage rebuilds every gpu's usage from outstanding allocations
+	RecomputeUsage() error
+
+	Close() error
+}